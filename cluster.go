@@ -1,56 +1,416 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Cluster struct {
 	name       string
 	nodes      map[string]*Node
 	dataSource *DataSource
+	// deadline of a single node state collection
+	nodeTimeout time.Duration
+	// master's wal locations collected across the scheduler ticks, lsnHistoryHost is the master they come from
+	lsnHistory     *LsnHistory
+	lsnHistoryHost string
+	// optional, nil if the heartbeat mode is disabled
+	heartbeat *Heartbeat
+	// roles and the master's timeline across the collections
+	roleTracker *RoleTracker
+	// optional, nil if the discovery mode is disabled
+	discovery *Discovery
+	// resolves the wal receivers' sender hosts, see ClusterState.resolveUpstreams
+	lookupHost func(host string) ([]string, error)
+	// the last collected state, read by the topology endpoints
+	lastStateMutex sync.Mutex
+	lastState      *ClusterState
 }
 
 type SlaveLag struct {
+	receiveLag          uint64
+	replayLag           uint64
+	replayLagSeconds    float64
+	hasReplayLagSeconds bool
+	// estimated from the master's wal locations history
+	estimatedReceiveLagSeconds    float64
+	hasEstimatedReceiveLagSeconds bool
+	estimatedReplayLagSeconds     float64
+	hasEstimatedReplayLagSeconds  bool
+	heartbeatLagSeconds           float64
+	hasHeartbeatLagSeconds        bool
+	// the standby is ahead of the master, the lag has been clamped to 0
+	negative bool
+}
+
+// UpstreamLag is a standby's lag relative to the node it receives wal from, either the master or a cascading standby
+type UpstreamLag struct {
+	// bytes the upstream has and the standby hasn't received yet
 	receiveLag uint64
-	replayLag  uint64
+	// bytes the upstream has and the standby hasn't replayed yet
+	replayLag uint64
 }
 
-func NewCluster(dataSource *DataSource, clusterName string, hosts []string) *Cluster {
+func NewCluster(dataSource *DataSource, clusterName string, hosts []string, nodeTimeout time.Duration, lsnHistorySize int) *Cluster {
 	cluster := &Cluster{}
 	cluster.name = clusterName
 	cluster.dataSource = dataSource
+	cluster.nodeTimeout = nodeTimeout
+	cluster.setLsnHistorySize(lsnHistorySize)
 	cluster.nodes = make(map[string]*Node)
+	cluster.roleTracker = NewRoleTracker()
+	cluster.lookupHost = net.LookupHost
+	cluster.setHosts(hosts)
+	return cluster
+}
+
+// ClusterState is a snapshot of all the nodes, more than one master means a split-brain
+type ClusterState struct {
+	masters []*NodeState
+	slaves  map[string]*NodeState
+	// nodes which haven't responded, their err is set
+	failed map[string]*NodeState
+	// nodes of another database cluster (system identifier), excluded from masters and slaves
+	foreign map[string]*NodeState
+	// role changes and failovers since the previous collection
+	roleChanges *RoleChanges
+	// discovered hosts removed by this collection, their series have to be deleted
+	expired []string
+}
+
+func (state *ClusterState) isSplitBrain() bool {
+	return len(state.masters) > 1
+}
+
+func (state *ClusterState) masterHosts() []string {
+	hosts := make([]string, 0, len(state.masters))
+	for _, master := range state.masters {
+		hosts = append(hosts, master.host)
+	}
+	return hosts
+}
+
+// all returns states of all the nodes
+func (state *ClusterState) all() []*NodeState {
+	all := make([]*NodeState, 0, len(state.masters)+len(state.slaves)+len(state.failed)+len(state.foreign))
+	all = append(all, state.masters...)
+	for _, slave := range state.slaves {
+		all = append(all, slave)
+	}
+	for _, failed := range state.failed {
+		all = append(all, failed)
+	}
+	for _, foreign := range state.foreign {
+		all = append(all, foreign)
+	}
+	return all
+}
+
+// setHosts adds and removes nodes, so the cluster consists of the given hosts and the discovered ones
+func (cluster *Cluster) setHosts(hosts []string) (added []string, removed []string) {
+	wanted := make(map[string]bool)
 	for _, host := range hosts {
-		cluster.nodes[host] = NewNode(cluster.dataSource, host)
+		wanted[host] = true
+		if cluster.discovery != nil {
+			// a configured node is no longer a discovered one
+			delete(cluster.discovery.discovered, host)
+		}
+		if cluster.nodes[host] == nil {
+			cluster.nodes[host] = NewNode(cluster.dataSource, host)
+			added = append(added, host)
+		}
 	}
-	return cluster
+	for host := range cluster.nodes {
+		if !wanted[host] && !cluster.isDiscovered(host) {
+			delete(cluster.nodes, host)
+			cluster.roleTracker.forget(host)
+			removed = append(removed, host)
+		}
+	}
+	return added, removed
+}
+
+// hosts returns the sorted hosts of the configured and the discovered nodes
+func (cluster *Cluster) hosts() []string {
+	hosts := make([]string, 0, len(cluster.nodes))
+	for host := range cluster.nodes {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func (cluster *Cluster) setLsnHistorySize(size int) {
+	cluster.lsnHistory = NewLsnHistory(size)
+	cluster.lsnHistoryHost = ""
 }
 
-func (cluster *Cluster) queryForState() (*NodeState, *map[string]*NodeState, error) {
-	var master = &NodeState{}
-	var slaves = make(map[string]*NodeState)
-	mi := 0
-	si := 0
+func (cluster *Cluster) queryForState() (*ClusterState, error) {
+	var state = &ClusterState{slaves: make(map[string]*NodeState), failed: make(map[string]*NodeState), foreign: make(map[string]*NodeState)}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	// nodes are queried concurrently, so a hung node delays the collection by the node timeout at most
 	for host, node := range cluster.nodes {
-		nodeState := node.queryForState()
-		if nodeState.err == nil {
-			if nodeState.isInRecovery {
-				slaves[host] = nodeState
-				si++
+		wg.Add(1)
+		go func(host string, node *Node) {
+			defer wg.Done()
+			nodeState := cluster.queryNodeForState(node)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if nodeState.err != nil {
+				log.warn("Can't collect %s state, error: %v", host, nodeState.err)
+				state.failed[host] = nodeState
+			} else if nodeState.isInRecovery {
+				state.slaves[host] = nodeState
 			} else {
-				if mi == 0 {
-					master = nodeState
-					mi++
-				} else {
-					return nil, nil, fmt.Errorf("too many masters, konwn %s, pretending: %s", master.host, node.host)
+				state.masters = append(state.masters, nodeState)
+			}
+		}(host, node)
+	}
+	wg.Wait()
+	sort.Slice(state.masters, func(i, j int) bool { return state.masters[i].host < state.masters[j].host })
+	// a node of an unrelated database would be a false split-brain or a meaningless lag
+	state.separateForeign()
+	for host, foreign := range state.foreign {
+		log.error("%s belongs to another database cluster, system identifier %s differs from %s", host, foreign.systemIdentifier, state.systemIdentifier())
+	}
+	state.expired = cluster.discoverNodes(state)
+	// standbys' locations have been read, so reading the master's location again brackets them:
+	// a standby can't be ahead of the master unless something is really wrong
+	for _, master := range state.masters {
+		cluster.requeryMasterWalLsn(master)
+	}
+	state.resolveUpstreams(cluster.lookupHost)
+	state.roleChanges = cluster.roleTracker.track(state)
+	cluster.setLastState(state)
+	return state, cluster.followMaster(state)
+}
+
+// followMaster feeds the master's wal location history and points the heartbeat writer to the master,
+// during a split-brain nothing follows any of the masters
+func (cluster *Cluster) followMaster(state *ClusterState) error {
+	if state.isSplitBrain() {
+		// nobody knows which master is the right one, the history and heartbeat stay with the last known one
+		log.error("split-brain, too many masters: %s", strings.Join(state.masterHosts(), ", "))
+		return nil
+	}
+	if len(state.masters) == 0 || len(state.slaves) == 0 {
+		return fmt.Errorf("this is not replication cluster, masters: %d, slaves: %d", len(state.masters), len(state.slaves))
+	}
+	for _, slave := range sortedNodeStates(state.slaves) {
+		if diverged, _ := state.isDiverged(slave); diverged {
+			log.error("%s timeline %d has diverged from the master's %d timeline history, pg_rewind or reclone is needed", slave.host, slave.timeline, state.masters[0].timeline)
+		}
+	}
+	master := state.masters[0]
+	cluster.updateLsnHistory(master, master.capturedAt)
+	if cluster.heartbeat != nil {
+		cluster.heartbeat.followMaster(master.host)
+	}
+	return nil
+}
+
+func (cluster *Cluster) queryNodeForState(node *Node) *NodeState {
+	ctx, cancel := context.WithTimeout(context.Background(), cluster.nodeTimeout)
+	defer cancel()
+	nodeState := node.queryForState(ctx)
+	if nodeState.err == nil && nodeState.isInRecovery && cluster.heartbeat != nil {
+		var err error
+		if nodeState.heartbeatAge, nodeState.hasHeartbeat, err = node.queryHeartbeatAge(ctx, cluster.heartbeat.table); err != nil {
+			log.warn("Can't read %s heartbeat, error: %v", node.host, err)
+		}
+	}
+	return nodeState
+}
+
+func (cluster *Cluster) requeryMasterWalLsn(master *NodeState) {
+	ctx, cancel := context.WithTimeout(context.Background(), cluster.nodeTimeout)
+	defer cancel()
+	requeried := *master
+	if err := cluster.nodes[master.host].queryCurrentWalLsn(ctx, &requeried); err != nil {
+		// the first read is still valid, it just can't guarantee the order
+		log.warn("Can't query %s current wal location again, error: %v", master.host, err)
+		return
+	}
+	master.currentWalLsn = requeried.currentWalLsn
+	master.currentWalLsnBytes = requeried.currentWalLsnBytes
+	master.capturedAt = requeried.capturedAt
+}
+
+// systemIdentifier returns the single master's system identifier; during a split-brain (or without a master)
+// the one shared by most of the nodes, masters win a tie; empty if unknown
+func (state *ClusterState) systemIdentifier() string {
+	if len(state.masters) == 1 && state.masters[0].systemIdentifier != "" {
+		return state.masters[0].systemIdentifier
+	}
+	candidates := append(append([]*NodeState{}, state.masters...), sortedNodeStates(state.slaves)...)
+	counts := make(map[string]int)
+	for _, nodeState := range candidates {
+		if nodeState.systemIdentifier != "" {
+			counts[nodeState.systemIdentifier]++
+		}
+	}
+	identifier := ""
+	for _, nodeState := range candidates {
+		if counts[nodeState.systemIdentifier] > counts[identifier] {
+			identifier = nodeState.systemIdentifier
+		}
+	}
+	return identifier
+}
+
+// separateForeign moves the nodes whose system identifier differs from the cluster's one to the foreign nodes,
+// nodes with unknown identifiers are trusted
+func (state *ClusterState) separateForeign() {
+	identifier := state.systemIdentifier()
+	if identifier == "" {
+		return
+	}
+	if state.foreign == nil {
+		state.foreign = make(map[string]*NodeState)
+	}
+	isForeign := func(nodeState *NodeState) bool {
+		return nodeState.systemIdentifier != "" && nodeState.systemIdentifier != identifier
+	}
+	var masters []*NodeState
+	for _, master := range state.masters {
+		if isForeign(master) {
+			state.foreign[master.host] = master
+		} else {
+			masters = append(masters, master)
+		}
+	}
+	state.masters = masters
+	for host, slave := range state.slaves {
+		if isForeign(slave) {
+			state.foreign[host] = slave
+			delete(state.slaves, host)
+		}
+	}
+}
+
+func (cluster *Cluster) setLastState(state *ClusterState) {
+	cluster.lastStateMutex.Lock()
+	defer cluster.lastStateMutex.Unlock()
+	cluster.lastState = state
+}
+
+func (cluster *Cluster) getLastState() *ClusterState {
+	cluster.lastStateMutex.Lock()
+	defer cluster.lastStateMutex.Unlock()
+	return cluster.lastState
+}
+
+// resolveUpstreams finds the cluster node each standby receives wal from: the wal receiver's sender host is the node's
+// host as configured or it resolves to the node's address, e.g. primary_conninfo uses the IP of a node configured by name
+// (resolved only if needed)
+func (state *ClusterState) resolveUpstreams(lookupHost func(host string) ([]string, error)) {
+	nodes := make(map[string]*NodeState)
+	for _, master := range state.masters {
+		nodes[master.host] = master
+	}
+	for host, slave := range state.slaves {
+		nodes[host] = slave
+	}
+	var addresses map[string]string
+	for _, slave := range state.slaves {
+		if slave.walReceiver == nil || slave.walReceiver.senderHost == "" {
+			continue
+		}
+		upstream := nodes[slave.walReceiver.senderHost]
+		if upstream == nil {
+			if addresses == nil {
+				hosts := make([]string, 0, len(nodes))
+				for host := range nodes {
+					hosts = append(hosts, host)
+				}
+				addresses = resolveAddresses(lookupHost, hosts)
+			}
+			for address := range resolveAddresses(lookupHost, []string{slave.walReceiver.senderHost}) {
+				if host, found := addresses[address]; found {
+					upstream = nodes[host]
+					break
 				}
 			}
 		}
+		if upstream != nil && upstream != slave {
+			slave.upstreamHost = upstream.host
+		} else {
+			log.debug("standby %s upstream %s:%s isn't a cluster node", slave.host, slave.walReceiver.senderHost, slave.walReceiver.senderPort)
+		}
+	}
+}
+
+// upstreamOf returns the node the standby receives wal from, nil if it is unknown
+func (state *ClusterState) upstreamOf(slave *NodeState) *NodeState {
+	if slave.upstreamHost == "" {
+		return nil
+	}
+	if upstream := state.slaves[slave.upstreamHost]; upstream != nil {
+		return upstream
 	}
-	if mi == 0 || si == 0 {
-		return master, &slaves, fmt.Errorf("this is not replication cluster, masters: %d, slaves: %d", mi, si)
+	for _, master := range state.masters {
+		if master.host == slave.upstreamHost {
+			return master
+		}
 	}
-	return master, &slaves, nil
+	return nil
+}
+
+// walPositionBytes returns the location the node can stream to its standbys:
+// the master's current location or the cascading standby's received (or replayed) one
+func (nodeState *NodeState) walPositionBytes() uint64 {
+	if !nodeState.isInRecovery {
+		return nodeState.currentWalLsnBytes
+	}
+	if nodeState.lastWalReplayLsnBytes > nodeState.lastWalReceiveLsnBytes {
+		return nodeState.lastWalReplayLsnBytes
+	}
+	return nodeState.lastWalReceiveLsnBytes
+}
+
+// calculateUpstreamLag compares the standby with its direct upstream, the lags can't be negative:
+// a cascading standby is read concurrently with its downstream, not bracketed like the master
+func calculateUpstreamLag(upstream NodeState, slave NodeState) *UpstreamLag {
+	lag := &UpstreamLag{}
+	position := upstream.walPositionBytes()
+	if position > slave.lastWalReceiveLsnBytes {
+		lag.receiveLag = position - slave.lastWalReceiveLsnBytes
+	}
+	if position > slave.lastWalReplayLsnBytes {
+		lag.replayLag = position - slave.lastWalReplayLsnBytes
+	}
+	return lag
+}
+
+// snapshotSpread returns the time between the first and the last wal location read
+func (state *ClusterState) snapshotSpread() time.Duration {
+	var first, last time.Time
+	for _, nodeState := range state.all() {
+		if nodeState.err != nil || nodeState.capturedAt.IsZero() {
+			continue
+		}
+		if first.IsZero() || nodeState.capturedAt.Before(first) {
+			first = nodeState.capturedAt
+		}
+		if last.IsZero() || nodeState.capturedAt.After(last) {
+			last = nodeState.capturedAt
+		}
+	}
+	return last.Sub(first)
+}
+
+func (cluster *Cluster) updateLsnHistory(master *NodeState, timestamp time.Time) {
+	if master.host != cluster.lsnHistoryHost {
+		cluster.lsnHistory.reset()
+		cluster.lsnHistoryHost = master.host
+	}
+	cluster.lsnHistory.add(timestamp, master.currentWalLsnBytes)
 }
 
 func (cluster *Cluster) calculateSlaveLag(master NodeState, slave NodeState) *SlaveLag {
@@ -60,21 +420,53 @@ func (cluster *Cluster) calculateSlaveLag(master NodeState, slave NodeState) *Sl
 	} else {
 		lag.receiveLag = 0
 	}
+	// the master's location is read after the standby's one, so the standby can't be ahead
+	lag.negative = slave.lastWalReceiveLsnBytes > master.currentWalLsnBytes || slave.lastWalReplayLsnBytes > master.currentWalLsnBytes
 	if slave.lastWalReceiveLsnBytes > slave.lastWalReplayLsnBytes {
 		lag.replayLag = slave.lastWalReceiveLsnBytes - slave.lastWalReplayLsnBytes
 	} else {
 		lag.replayLag = 0
 	}
+	if slave.lastWalReplayLsnBytes >= master.currentWalLsnBytes {
+		// nothing to replay, on an idle master the last transaction timestamp gets older and older
+		lag.replayLagSeconds = 0
+		lag.hasReplayLagSeconds = true
+	} else if slave.hasLastXactReplay {
+		lag.replayLagSeconds = correctClockSkew(slave.lastXactReplayAge, master, slave)
+		lag.hasReplayLagSeconds = true
+	}
+	if cluster.lsnHistory != nil && cluster.lsnHistoryHost == master.host {
+		lag.estimatedReceiveLagSeconds, lag.hasEstimatedReceiveLagSeconds = cluster.lsnHistory.estimateLag(slave.lastWalReceiveLsnBytes)
+		lag.estimatedReplayLagSeconds, lag.hasEstimatedReplayLagSeconds = cluster.lsnHistory.estimateLag(slave.lastWalReplayLsnBytes)
+	}
+	if slave.hasHeartbeat {
+		lag.heartbeatLagSeconds = correctClockSkew(slave.heartbeatAge, master, slave)
+		lag.hasHeartbeatLagSeconds = true
+	}
 	log.debug("calculate lag between master slave %s:\n"+
 		"  master.currentWalLsn    = %d (%s)\n"+
 		"  slave.lastWalReceiveLsn = %d (%s)\n"+
 		"  slave.lastWalReplayLsn  = %d (%s)\n"+
 		"  slave.receiveLag        = %d\n"+
-		"  slave.replayLag         = %d",
+		"  slave.replayLag         = %d\n"+
+		"  slave.replayLagSeconds  = %f (known: %t)",
 		slave.host,
 		master.currentWalLsnBytes, master.currentWalLsn,
 		slave.lastWalReceiveLsnBytes, slave.lastWalReceiveLsn,
 		slave.lastWalReplayLsnBytes, slave.lastWalReplayLsn,
-		lag.receiveLag, lag.replayLag)
+		lag.receiveLag, lag.replayLag,
+		lag.replayLagSeconds, lag.hasReplayLagSeconds)
 	return lag
 }
+
+// correctClockSkew corrects the age of a master's timestamp measured with the standby's clock
+func correctClockSkew(age float64, master NodeState, slave NodeState) float64 {
+	if !master.hasClockSkew || !slave.hasClockSkew {
+		return age
+	}
+	corrected := age - (slave.clockSkew - master.clockSkew).Seconds()
+	if corrected < 0 {
+		return 0
+	}
+	return corrected
+}
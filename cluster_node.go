@@ -1,65 +1,524 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Node struct {
 	host string
 	db   *DataSource
+	// queries matching the node's server version, detected on the first collection and after a failed one
+	catalog *QueryCatalog
+	// read together with the catalog, empty if unknown
+	systemIdentifier string
+	// the master's timeline history is read once per timeline, valid if hasTimelineHistory
+	historyTimeline    int64
+	timelineHistory    []*TimelineHistoryEntry
+	hasTimelineHistory bool
 }
 
 type NodeState struct {
-	host                   string
-	err                    error
-	isInRecovery           bool
+	host string
+	err  error
+	// how long the collection took, timedOut is set if it has exceeded the node timeout
+	collectionDuration time.Duration
+	timedOut           bool
+	// when the wal locations have been read (exporter's clock)
+	capturedAt time.Time
+	// node's clock minus exporter's clock, valid if hasClockSkew
+	clockSkew        time.Duration
+	hasClockSkew     bool
+	serverVersionNum int
+	serverVersion    string
+	// pg_control_system().system_identifier, nodes of a replication cluster share it, empty if unknown
+	systemIdentifier string
+	isInRecovery     bool
+	// the master's current timeline or the standby's received one, valid if hasTimeline
+	timeline    int64
+	hasTimeline bool
+	// the master's timeline history, empty on the first timeline, valid if hasTimelineHistory
+	timelineHistory        []*TimelineHistoryEntry
+	hasTimelineHistory     bool
 	currentWalLsn          string
 	currentWalLsnBytes     uint64
 	lastWalReceiveLsn      string
 	lastWalReceiveLsnBytes uint64
 	lastWalReplayLsn       string
 	lastWalReplayLsnBytes  uint64
+	// seconds since the last transaction replayed during recovery, valid if hasLastXactReplay
+	lastXactReplayAge float64
+	hasLastXactReplay bool
+	// seconds since the heartbeat visible on the standby has been written on the master, valid if hasHeartbeat
+	heartbeatAge float64
+	hasHeartbeat bool
+	// nil if the standby's wal receiver isn't running, valid if hasWalReceiverStatus
+	walReceiver          *WalReceiverState
+	hasWalReceiverStatus bool
+	// the cluster node the wal receiver's sender host points at, see ClusterState.resolveUpstreams
+	upstreamHost string
+	// the master's pg_stat_replication rows, valid if hasWalSenders
+	walSenders       []*WalSenderState
+	hasWalSenders    bool
+	replicationSlots []*ReplicationSlotState
+	// the raw setting and the parsed one (nil if the replication is asynchronous), valid if hasSyncStandbyNames
+	synchronousStandbyNames string
+	syncStandbyNames        *SyncStandbyNames
+	hasSyncStandbyNames     bool
 }
 
-func NewNode(db *DataSource, host string) *Node {
-	return &Node{host: host, db: db}
+// WalSenderState is the master's view of a single standby: a row of pg_stat_replication
+type WalSenderState struct {
+	applicationName  string
+	clientAddr       string
+	state            string
+	syncState        string
+	sentLsn          string
+	sentLsnBytes     uint64
+	writeLsn         string
+	writeLsnBytes    uint64
+	flushLsn         string
+	flushLsnBytes    uint64
+	replayLsn        string
+	replayLsnBytes   uint64
+	writeLagSeconds  float64
+	flushLagSeconds  float64
+	replayLagSeconds float64
+	hasLag           bool
+	syncPriority     int64
 }
 
-func (n *Node) queryIsInRecovery() (bool, error) {
-	var isInRecoveryStr string
-	var err error
-	if isInRecoveryStr, err = n.db.QueryStrWithEffort(n.host, "SELECT pg_is_in_recovery()::TEXT"); err != nil {
-		return false, fmt.Errorf("failed to query recovery mode: %v", err)
-	}
-	return isInRecoveryStr == "true", nil
+// WalReceiverState is the standby's pg_stat_wal_receiver row, the ages are measured with the standby's clock
+type WalReceiverState struct {
+	// the standby's upstream, empty if unknown
+	senderHost  string
+	senderPort  string
+	status      string
+	slotName    string
+	receivedTli int64
+	// seconds since the last message has been sent by the upstream, valid if hasLastMsgSendAge
+	lastMsgSendAge       float64
+	hasLastMsgSendAge    bool
+	lastMsgReceiptAge    float64
+	hasLastMsgReceiptAge bool
+	// the last wal location reported to the upstream
+	latestEndLsn      string
+	latestEndLsnBytes uint64
+	latestEndAge      float64
+	hasLatestEndAge   bool
+}
+
+func (r *WalReceiverState) isStreaming() bool {
+	return r != nil && r.status == "streaming"
+}
+
+// ReplicationSlotState is a row of the master's pg_replication_slots
+type ReplicationSlotState struct {
+	slotName         string
+	slotType         string
+	active           bool
+	walStatus        string
+	safeWalSize      int64
+	hasSafeWalSize   bool
+	restartLsn       string
+	restartLsnBytes  uint64
+	retainedWalBytes uint64
+}
+
+// isInactiveRetainingWal tells if the slot is abandoned but still keeps WAL on the master's disk
+func (s *ReplicationSlotState) isInactiveRetainingWal() bool {
+	return !s.active && s.retainedWalBytes > 0
+}
+
+func NewNode(db *DataSource, host string) *Node {
+	return &Node{host: host, db: db}
 }
 
-func (n *Node) queryForState() *NodeState {
+func (n *Node) queryForState(ctx context.Context) *NodeState {
 	var state = &NodeState{}
 	state.host = n.host
-	state.isInRecovery, state.err = n.queryIsInRecovery()
-	if state.err == nil {
-		// https://www.postgresql.org/docs/current/functions-admin.html
-		if state.isInRecovery {
-			// SLAVE
-			if state.lastWalReceiveLsn, state.err = n.db.QueryStrWithEffort(n.host, "SELECT COALESCE(pg_last_wal_receive_lsn(),'0/0')"); state.err == nil {
-				state.lastWalReceiveLsnBytes, state.err = parsePgLsn(state.lastWalReceiveLsn)
-			} else {
-				state.err = fmt.Errorf("failed to query last received wal location: %v", state.err)
-			}
-			if state.lastWalReplayLsn, state.err = n.db.QueryStrWithEffort(n.host, "SELECT COALESCE(pg_last_wal_replay_lsn(),'0/0')"); state.err == nil {
-				state.lastWalReplayLsnBytes, state.err = parsePgLsn(state.lastWalReplayLsn)
-			} else {
-				state.err = fmt.Errorf("failed to query last replayed wal location: %v", state.err)
+	start := time.Now()
+	defer func() {
+		state.collectionDuration = time.Since(start)
+		state.timedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
+	}()
+	defer func() {
+		if state.err != nil {
+			// the node may have been upgraded meanwhile
+			n.catalog = nil
+		}
+	}()
+	if n.catalog == nil {
+		if n.catalog, state.err = n.queryServerVersion(ctx); state.err != nil {
+			return state
+		}
+		n.systemIdentifier, n.historyTimeline = "", 0
+		if n.catalog.systemIdentifier != "" {
+			// pg_control_system() may require extra privileges, the node is trusted then
+			var identifierErr error
+			if n.systemIdentifier, identifierErr = n.db.QueryStrWithEffort(ctx, n.host, n.catalog.systemIdentifier); identifierErr != nil {
+				log.warn("Can't query %s system identifier, error: %v", n.host, identifierErr)
 			}
+		}
+	}
+	state.serverVersionNum, state.serverVersion = n.catalog.serverVersionNum, n.catalog.serverVersion
+	state.systemIdentifier = n.systemIdentifier
+	// the role, all the wal locations and the clock are read in a single round trip, so they are consistent
+	queryStart := time.Now()
+	row, err := n.db.QueryRowWithEffort(ctx, n.host, n.catalog.state)
+	if err != nil {
+		state.err = fmt.Errorf("failed to query node state: %w", err)
+		return state
+	}
+	state.capturedAt = time.Now()
+	// the node's clock is compared with the exporter's one in the middle of the query round trip
+	if state.err = parseState(row, state, queryStart.Add(state.capturedAt.Sub(queryStart)/2)); state.err != nil {
+		state.err = &ParseError{what: "node state", err: state.err}
+		return state
+	}
+	if state.isInRecovery && n.catalog.walReceiver != "" {
+		// the wal receiver's status is optional, it can't hide the standby
+		var walReceiverErr error
+		if state.walReceiver, walReceiverErr = n.queryWalReceiver(ctx); walReceiverErr != nil {
+			log.warn("Can't collect %s wal receiver, error: %v", n.host, walReceiverErr)
 		} else {
-			// MASTER
-			if state.currentWalLsn, state.err = n.db.QueryStrWithEffort(n.host, "SELECT COALESCE(pg_current_wal_lsn(),'0/0')"); state.err == nil {
-				state.currentWalLsnBytes, state.err = parsePgLsn(state.currentWalLsn)
-			} else {
-				state.err = fmt.Errorf("failed to query current wal location: %v", state.err)
+			state.hasWalReceiverStatus = true
+		}
+	}
+	if state.isInRecovery {
+		controlTimeline, hasControlTimeline := n.queryStandbyTimeline(ctx, state)
+		state.setStandbyTimeline(controlTimeline, hasControlTimeline)
+	}
+	if !state.isInRecovery {
+		// the master's own view of its standbys is optional, it can't hide the master
+		var walSendersErr error
+		if state.walSenders, walSendersErr = n.queryWalSenders(ctx); walSendersErr != nil {
+			log.warn("Can't collect %s wal senders, error: %v", n.host, walSendersErr)
+		} else {
+			state.hasWalSenders = true
+		}
+		var slotsErr error
+		if state.replicationSlots, slotsErr = n.queryReplicationSlots(ctx, state.currentWalLsnBytes); slotsErr != nil {
+			log.warn("Can't collect %s replication slots, error: %v", n.host, slotsErr)
+		}
+		var syncErr error
+		if state.syncStandbyNames, syncErr = parseSyncStandbyNames(state.synchronousStandbyNames); syncErr != nil {
+			log.warn("Can't parse %s synchronous_standby_names, error: %v", n.host, syncErr)
+		} else {
+			state.hasSyncStandbyNames = true
+		}
+		if state.hasTimeline {
+			if state.timeline != n.historyTimeline {
+				n.historyTimeline = state.timeline
+				n.timelineHistory, n.hasTimelineHistory = n.queryTimelineHistory(ctx, state.timeline)
 			}
+			state.timelineHistory, state.hasTimelineHistory = n.timelineHistory, n.hasTimelineHistory
 		}
 	}
 	return state
 }
+
+// queryStandbyTimeline reads the standby's own timeline, needed only if its wal receiver isn't streaming,
+// e.g. a diverged former master can't stream; pg_control_checkpoint() may require extra privileges
+func (n *Node) queryStandbyTimeline(ctx context.Context, state *NodeState) (int64, bool) {
+	if n.catalog.standbyTimeline == "" || (state.walReceiver.isStreaming() && state.walReceiver.receivedTli > 0) {
+		return 0, false
+	}
+	value, err := n.db.QueryStrWithEffort(ctx, n.host, n.catalog.standbyTimeline)
+	if err != nil {
+		log.warn("Can't query %s control file timeline, error: %v", n.host, err)
+		return 0, false
+	}
+	timeline, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.warn("Can't parse %s control file timeline, error: %v", n.host, err)
+		return 0, false
+	}
+	return timeline, timeline > 0
+}
+
+// setStandbyTimeline prefers the streaming wal receiver's timeline, the control file's one lags behind it
+func (state *NodeState) setStandbyTimeline(controlTimeline int64, hasControlTimeline bool) {
+	if state.walReceiver.isStreaming() && state.walReceiver.receivedTli > 0 {
+		state.timeline, state.hasTimeline = state.walReceiver.receivedTli, true
+	} else if hasControlTimeline {
+		state.timeline, state.hasTimeline = controlTimeline, true
+	}
+}
+
+// queryTimelineHistory reads the timeline's history file, pg_read_file() may require extra privileges,
+// the divergence of the standbys is unknown then
+func (n *Node) queryTimelineHistory(ctx context.Context, timeline int64) ([]*TimelineHistoryEntry, bool) {
+	if timeline == 1 {
+		// the first timeline has no history file
+		return nil, true
+	}
+	content, err := n.db.QueryStrWithEffort(ctx, n.host, fmt.Sprintf(n.catalog.timelineHistory, timeline))
+	if err != nil {
+		log.warn("Can't read %s timeline %d history, error: %v", n.host, timeline, err)
+		return nil, false
+	}
+	history, err := parseTimelineHistory(content)
+	if err != nil {
+		log.warn("Can't parse %s timeline %d history, error: %v", n.host, timeline, err)
+		return nil, false
+	}
+	return history, true
+}
+
+func (n *Node) queryServerVersion(ctx context.Context) (*QueryCatalog, error) {
+	row, err := n.db.QueryRowWithEffort(ctx, n.host, serverVersionQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query server version: %w", err)
+	}
+	catalog, err := parseServerVersion(row)
+	if err != nil {
+		return nil, &ParseError{what: "server version", err: err}
+	}
+	return catalog, nil
+}
+
+// parseState parses the QueryCatalog.state result row, localTime is the exporter's time the node's clock is compared with
+func parseState(row []string, state *NodeState, localTime time.Time) error {
+	if len(row) != 8 {
+		return fmt.Errorf("unexpected columns count: %d", len(row))
+	}
+	var err error
+	state.synchronousStandbyNames = row[6]
+	state.isInRecovery = row[0] == "true"
+	if state.isInRecovery {
+		state.lastWalReceiveLsn, state.lastWalReplayLsn = row[2], row[3]
+		if state.lastWalReceiveLsnBytes, err = parsePgLsn(state.lastWalReceiveLsn); err != nil {
+			return err
+		}
+		if state.lastWalReplayLsnBytes, err = parsePgLsn(state.lastWalReplayLsn); err != nil {
+			return err
+		}
+		// unknown if no transaction has been replayed since the standby started
+		if row[4] != "" {
+			if state.lastXactReplayAge, err = strconv.ParseFloat(row[4], 64); err != nil {
+				return err
+			}
+			state.hasLastXactReplay = true
+		}
+	} else {
+		state.currentWalLsn = row[1]
+		if state.currentWalLsnBytes, err = parsePgLsn(state.currentWalLsn); err != nil {
+			return err
+		}
+		// wal file name: 8 hex digits of the timeline, 16 of the location
+		if len(row[7]) != 24 {
+			return fmt.Errorf("unexpected wal file name `%s`", row[7])
+		}
+		if state.timeline, err = strconv.ParseInt(row[7][:8], 16, 64); err != nil {
+			return err
+		}
+		state.hasTimeline = true
+	}
+	var serverTime float64
+	if serverTime, err = strconv.ParseFloat(row[5], 64); err != nil {
+		return err
+	}
+	state.clockSkew = time.Duration((serverTime - float64(localTime.UnixNano())/1e9) * float64(time.Second))
+	state.hasClockSkew = true
+	return nil
+}
+
+// queryWalReceiver returns nil if the wal receiver isn't running
+func (n *Node) queryWalReceiver(ctx context.Context) (*WalReceiverState, error) {
+	rows, err := n.db.QueryRowsWithEffort(ctx, n.host, n.catalog.walReceiver)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query wal receiver: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	receiver, err := parseWalReceiver(rows[0])
+	if err != nil {
+		return nil, &ParseError{what: "wal receiver", err: err}
+	}
+	return receiver, nil
+}
+
+func parseWalReceiver(row []string) (*WalReceiverState, error) {
+	if len(row) != 10 {
+		return nil, fmt.Errorf("unexpected columns count: %d", len(row))
+	}
+	var err error
+	r := &WalReceiverState{
+		senderHost:   row[0],
+		senderPort:   row[1],
+		status:       row[3],
+		latestEndLsn: row[7],
+		slotName:     row[9],
+	}
+	if r.senderHost == "" {
+		// conninfo: "user=replicator host=10.0.0.1 port=5432 ...", a host list means any of them
+		for _, field := range strings.Fields(row[2]) {
+			key, value, found := strings.Cut(field, "=")
+			if !found {
+				continue
+			}
+			value = strings.Trim(value, "'")
+			switch key {
+			case "host":
+				r.senderHost, _, _ = strings.Cut(value, ",")
+			case "port":
+				r.senderPort, _, _ = strings.Cut(value, ",")
+			}
+		}
+	}
+	if r.receivedTli, err = strconv.ParseInt(row[4], 10, 64); err != nil {
+		return nil, err
+	}
+	if r.lastMsgSendAge, r.hasLastMsgSendAge, err = parseOptionalFloat(row[5]); err != nil {
+		return nil, err
+	}
+	if r.lastMsgReceiptAge, r.hasLastMsgReceiptAge, err = parseOptionalFloat(row[6]); err != nil {
+		return nil, err
+	}
+	if r.latestEndLsnBytes, err = parsePgLsn(r.latestEndLsn); err != nil {
+		return nil, err
+	}
+	if r.latestEndAge, r.hasLatestEndAge, err = parseOptionalFloat(row[8]); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// parseOptionalFloat parses a nullable number, NULL is returned as an empty string
+func parseOptionalFloat(s string) (float64, bool, error) {
+	if s == "" {
+		return 0, false, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return v, true, nil
+}
+
+// queryCurrentWalLsn reads the master's current wal location into the state
+func (n *Node) queryCurrentWalLsn(ctx context.Context, state *NodeState) error {
+	var err error
+	if n.catalog == nil {
+		return fmt.Errorf("unknown server version")
+	}
+	if state.currentWalLsn, err = n.db.QueryStrWithEffort(ctx, n.host, n.catalog.currentWalLsn); err != nil {
+		return fmt.Errorf("failed to query current wal location: %w", err)
+	}
+	state.capturedAt = time.Now()
+	state.currentWalLsnBytes, err = parsePgLsn(state.currentWalLsn)
+	return err
+}
+
+func (n *Node) queryWalSenders(ctx context.Context) ([]*WalSenderState, error) {
+	rows, err := n.db.QueryRowsWithEffort(ctx, n.host, n.catalog.walSenders)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query replication stats: %w", err)
+	}
+	var senders []*WalSenderState
+	for _, row := range rows {
+		sender, err := parseWalSender(row, n.catalog.hasReplicationLag)
+		if err != nil {
+			return nil, &ParseError{what: "replication stats", err: err}
+		}
+		senders = append(senders, sender)
+	}
+	return senders, nil
+}
+
+// parseWalSender parses a pg_stat_replication row, the lag columns are parsed only if hasLag
+func parseWalSender(row []string, hasLag bool) (*WalSenderState, error) {
+	if len(row) != 12 {
+		return nil, fmt.Errorf("unexpected columns count: %d", len(row))
+	}
+	var err error
+	s := &WalSenderState{
+		applicationName: row[0],
+		clientAddr:      row[1],
+		state:           row[2],
+		syncState:       row[3],
+		sentLsn:         row[4],
+		writeLsn:        row[5],
+		flushLsn:        row[6],
+		replayLsn:       row[7],
+	}
+	if s.sentLsnBytes, err = parsePgLsn(s.sentLsn); err != nil {
+		return nil, err
+	}
+	if s.writeLsnBytes, err = parsePgLsn(s.writeLsn); err != nil {
+		return nil, err
+	}
+	if s.flushLsnBytes, err = parsePgLsn(s.flushLsn); err != nil {
+		return nil, err
+	}
+	if s.replayLsnBytes, err = parsePgLsn(s.replayLsn); err != nil {
+		return nil, err
+	}
+	if hasLag {
+		if s.writeLagSeconds, err = strconv.ParseFloat(row[8], 64); err != nil {
+			return nil, err
+		}
+		if s.flushLagSeconds, err = strconv.ParseFloat(row[9], 64); err != nil {
+			return nil, err
+		}
+		if s.replayLagSeconds, err = strconv.ParseFloat(row[10], 64); err != nil {
+			return nil, err
+		}
+		s.hasLag = true
+	}
+	if s.syncPriority, err = strconv.ParseInt(row[11], 10, 64); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (n *Node) queryReplicationSlots(ctx context.Context, currentWalLsnBytes uint64) ([]*ReplicationSlotState, error) {
+	rows, err := n.db.QueryRowsWithEffort(ctx, n.host, n.catalog.replicationSlots)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query replication slots: %w", err)
+	}
+	var slots []*ReplicationSlotState
+	for _, row := range rows {
+		slot, err := parseReplicationSlot(row, currentWalLsnBytes)
+		if err != nil {
+			return nil, &ParseError{what: "replication slots", err: err}
+		}
+		slots = append(slots, slot)
+	}
+	return slots, nil
+}
+
+func parseReplicationSlot(row []string, currentWalLsnBytes uint64) (*ReplicationSlotState, error) {
+	if len(row) != 6 {
+		return nil, fmt.Errorf("unexpected columns count: %d", len(row))
+	}
+	var err error
+	s := &ReplicationSlotState{
+		slotName:   row[0],
+		slotType:   row[1],
+		active:     row[2] == "true",
+		walStatus:  row[3],
+		restartLsn: row[5],
+	}
+	// safe_wal_size is NULL for lost slots and when max_slot_wal_keep_size is -1
+	if row[4] != "" {
+		if s.safeWalSize, err = strconv.ParseInt(row[4], 10, 64); err != nil {
+			return nil, err
+		}
+		s.hasSafeWalSize = true
+	}
+	if s.restartLsnBytes, err = parsePgLsn(s.restartLsn); err != nil {
+		return nil, err
+	}
+	// restart_lsn is NULL (0/0) when the slot doesn't reserve any WAL
+	if s.restartLsnBytes > 0 && currentWalLsnBytes > s.restartLsnBytes {
+		s.retainedWalBytes = currentWalLsnBytes - s.restartLsnBytes
+	}
+	return s, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestNode_parseWalSender(t *testing.T) {
+	row := []string{"walreceiver", "10.0.0.2", "streaming", "async", "0/189B2E78", "0/189B2E78", "0/90000A1", "0/90000A0", "0.000512", "0.001024", "1.5", "0"}
+	s, err := parseWalSender(row, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "walreceiver", s.applicationName)
+	assert.Equal(t, "streaming", s.state)
+	assert.Equal(t, uint64(412_823_160), s.sentLsnBytes)
+	assert.Equal(t, uint64(150_995_104), s.replayLsnBytes)
+	assert.True(t, s.hasLag)
+	assert.Equal(t, 1.5, s.replayLagSeconds)
+
+	// PostgreSQL 9.x has no lag columns, they are NULL
+	s, err = parseWalSender([]string{"walreceiver", "10.0.0.2", "streaming", "async", "0/189B2E78", "0/189B2E78", "0/90000A1", "0/90000A0", "", "", "", "0"}, false)
+	assert.NoError(t, err)
+	assert.False(t, s.hasLag)
+	assert.Equal(t, float64(0), s.replayLagSeconds)
+
+	_, err = parseWalSender(row[:5], true)
+	assert.Error(t, err)
+}
+
+func TestMeasurer_updateWalSenders(t *testing.T) {
+	measurer := NewMeasurer(NewMetrics(prometheus.NewRegistry(), nil), "test", nil)
+	measurer.updateWalSenders(&NodeState{host: "node-1", walSenders: []*WalSenderState{
+		{applicationName: "node-2", clientAddr: "10.0.0.2", replayLagSeconds: 1.5, hasLag: true},
+		// PostgreSQL 9.x
+		{applicationName: "node-3", clientAddr: "10.0.0.3"},
+	}})
+	assert.Equal(t, 2, testutil.CollectAndCount(measurer.walSenderReplayLsnBytes))
+	assert.Equal(t, 1, testutil.CollectAndCount(measurer.walSenderWriteLagSeconds))
+	assert.Equal(t, 1, testutil.CollectAndCount(measurer.walSenderFlushLagSeconds))
+	assert.Equal(t, 1, testutil.CollectAndCount(measurer.walSenderReplayLagSeconds))
+}
+
+func TestNode_parseReplicationSlot(t *testing.T) {
+	cwLsn, _ := parsePgLsn("0/189B2E78") // 412_823_160
+
+	s, err := parseReplicationSlot([]string{"standby_1", "physical", "false", "extended", "", "0/90000A0"}, cwLsn)
+	assert.NoError(t, err)
+	assert.False(t, s.active)
+	assert.False(t, s.hasSafeWalSize)
+	assert.Equal(t, uint64(261_828_056), s.retainedWalBytes)
+	assert.True(t, s.isInactiveRetainingWal())
+
+	s, err = parseReplicationSlot([]string{"standby_2", "physical", "true", "reserved", "1073741824", "0/189B2E78"}, cwLsn)
+	assert.NoError(t, err)
+	assert.True(t, s.hasSafeWalSize)
+	assert.Equal(t, int64(1_073_741_824), s.safeWalSize)
+	assert.Equal(t, uint64(0), s.retainedWalBytes)
+	assert.False(t, s.isInactiveRetainingWal())
+
+	// a slot which has never reserved WAL doesn't retain anything
+	s, err = parseReplicationSlot([]string{"standby_3", "physical", "false", "", "", "0/0"}, cwLsn)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), s.retainedWalBytes)
+}
+
+func TestNode_parseState(t *testing.T) {
+	localTime := time.Unix(1_700_000_000, 0)
+
+	master := &NodeState{}
+	err := parseState([]string{"false", "0/189B2E78", "0/0", "0/0", "", "1700000000.25", "ANY 2 (node_2, node_3)", "000000030000000000000018"}, master, localTime)
+	assert.NoError(t, err)
+	assert.False(t, master.isInRecovery)
+	assert.Equal(t, uint64(412_823_160), master.currentWalLsnBytes)
+	assert.True(t, master.hasClockSkew)
+	assert.Equal(t, 250*time.Millisecond, master.clockSkew)
+	assert.Equal(t, "ANY 2 (node_2, node_3)", master.synchronousStandbyNames)
+	assert.True(t, master.hasTimeline)
+	assert.Equal(t, int64(3), master.timeline)
+
+	slave := &NodeState{}
+	err = parseState([]string{"true", "0/0", "0/189B2E78", "0/90000A0", "1.5", "1699999999.5", "", ""}, slave, localTime)
+	assert.NoError(t, err)
+	assert.True(t, slave.isInRecovery)
+	assert.Equal(t, uint64(412_823_160), slave.lastWalReceiveLsnBytes)
+	assert.Equal(t, uint64(150_995_104), slave.lastWalReplayLsnBytes)
+	assert.True(t, slave.hasLastXactReplay)
+	assert.Equal(t, 1.5, slave.lastXactReplayAge)
+	assert.Equal(t, -500*time.Millisecond, slave.clockSkew)
+
+	slave = &NodeState{}
+	err = parseState([]string{"true", "0/0", "0/189B2E78", "0/90000A0", "", "1700000000", "", ""}, slave, localTime)
+	assert.NoError(t, err)
+	assert.False(t, slave.hasLastXactReplay)
+
+	assert.Error(t, parseState([]string{"true", "0/0", "bad", "0/0", "", "1700000000", "", ""}, &NodeState{}, localTime))
+	assert.Error(t, parseState([]string{"true"}, &NodeState{}, localTime))
+}
+
+func TestNode_parseWalReceiver(t *testing.T) {
+	r, err := parseWalReceiver([]string{"node-1", "5432", "user=replicator host=10.0.0.1 port=6432", "streaming", "3", "0.25", "0.5", "0/189B2E78", "1.5", "node_2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "node-1", r.senderHost)
+	assert.Equal(t, "5432", r.senderPort)
+	assert.True(t, r.isStreaming())
+	assert.Equal(t, int64(3), r.receivedTli)
+	assert.True(t, r.hasLastMsgSendAge)
+	assert.Equal(t, 0.5, r.lastMsgReceiptAge)
+	assert.Equal(t, uint64(412_823_160), r.latestEndLsnBytes)
+	assert.Equal(t, 1.5, r.latestEndAge)
+	assert.Equal(t, "node_2", r.slotName)
+
+	// before PostgreSQL 11 the sender comes from conninfo
+	r, err = parseWalReceiver([]string{"", "", "user=replicator password=******** host='node-1,node-2' port=6432", "waiting", "3", "", "", "0/0", "", ""})
+	assert.NoError(t, err)
+	assert.Equal(t, "node-1", r.senderHost)
+	assert.Equal(t, "6432", r.senderPort)
+	assert.False(t, r.isStreaming())
+	assert.False(t, r.hasLastMsgSendAge)
+	assert.False(t, r.hasLatestEndAge)
+
+	_, err = parseWalReceiver([]string{"node-1"})
+	assert.Error(t, err)
+}
+
+func TestNode_queryForStateParseError(t *testing.T) {
+	fakeNodes.Store("malformed-1", &fakeNode{malformed: true})
+	measurer := NewMeasurer(NewMetrics(prometheus.NewRegistry(), nil), "test", nil)
+	dataSource := NewDataSource(measurer, &ClusterConfig{User: "monitor", Password: "secret", MaxOpenConns: 1})
+	dataSource.driverName = "fake"
+	defer dataSource.close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	state := NewNode(dataSource, "malformed-1").queryForState(ctx)
+	assert.EqualError(t, state.err, "failed to parse node state: unexpected columns count: 7")
+	assert.Equal(t, errorCategoryParse, categorizeError(state.err))
+}
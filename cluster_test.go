@@ -1,8 +1,20 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestCluster_calculateLag(t *testing.T) {
@@ -24,3 +36,338 @@ func TestCluster_calculateLag(t *testing.T) {
 	assert.Equal(t, uint64(261_828_055), lag.receiveLag)
 	assert.Equal(t, uint64(1), lag.replayLag)
 }
+
+func TestCluster_calculateReplayLagSeconds(t *testing.T) {
+	cwLsn, _ := parsePgLsn("0/189B2E78")
+	m := NodeState{
+		host:               "testMaster",
+		currentWalLsnBytes: cwLsn,
+	}
+	lwrpLsn, _ := parsePgLsn("0/90000A0")
+	s := NodeState{
+		host:                   "testSlave",
+		lastWalReceiveLsnBytes: lwrpLsn,
+		lastWalReplayLsnBytes:  lwrpLsn,
+		lastXactReplayAge:      42.5,
+		hasLastXactReplay:      true,
+	}
+	cluster := &Cluster{}
+	lag := cluster.calculateSlaveLag(m, s)
+	assert.True(t, lag.hasReplayLagSeconds)
+	assert.Equal(t, 42.5, lag.replayLagSeconds)
+
+	// idle master: everything has been replayed, the last transaction timestamp doesn't matter
+	s.lastWalReceiveLsnBytes = cwLsn
+	s.lastWalReplayLsnBytes = cwLsn
+	lag = cluster.calculateSlaveLag(m, s)
+	assert.True(t, lag.hasReplayLagSeconds)
+	assert.Equal(t, float64(0), lag.replayLagSeconds)
+
+	// nothing replayed since the standby start
+	s.lastWalReplayLsnBytes = lwrpLsn
+	s.hasLastXactReplay = false
+	lag = cluster.calculateSlaveLag(m, s)
+	assert.False(t, lag.hasReplayLagSeconds)
+}
+
+func TestCluster_calculateLagAnomalyAndClockSkew(t *testing.T) {
+	m := NodeState{
+		host:               "testMaster",
+		currentWalLsnBytes: 1000,
+		clockSkew:          -2 * time.Second,
+		hasClockSkew:       true,
+	}
+	s := NodeState{
+		host:                   "testSlave",
+		lastWalReceiveLsnBytes: 900,
+		lastWalReplayLsnBytes:  800,
+		lastXactReplayAge:      10,
+		hasLastXactReplay:      true,
+		heartbeatAge:           4,
+		hasHeartbeat:           true,
+		clockSkew:              3 * time.Second,
+		hasClockSkew:           true,
+	}
+	cluster := &Cluster{}
+	lag := cluster.calculateSlaveLag(m, s)
+	assert.False(t, lag.negative)
+	// the standby's clock is 5 seconds ahead of the master's one
+	assert.Equal(t, float64(5), lag.replayLagSeconds)
+	assert.Equal(t, float64(0), lag.heartbeatLagSeconds)
+
+	s.lastWalReceiveLsnBytes = 1001
+	lag = cluster.calculateSlaveLag(m, s)
+	assert.True(t, lag.negative)
+	assert.Equal(t, uint64(0), lag.receiveLag)
+}
+
+func TestClusterState_upstreams(t *testing.T) {
+	master := &NodeState{host: "node-1", currentWalLsnBytes: 1000}
+	direct := &NodeState{host: "node-2", isInRecovery: true, walReceiver: &WalReceiverState{senderHost: "node-1"}, lastWalReceiveLsnBytes: 900, lastWalReplayLsnBytes: 800}
+	cascaded := &NodeState{host: "node-3", isInRecovery: true, walReceiver: &WalReceiverState{senderHost: "node-2"}, lastWalReceiveLsnBytes: 850, lastWalReplayLsnBytes: 850}
+	foreign := &NodeState{host: "node-4", isInRecovery: true, walReceiver: &WalReceiverState{senderHost: "10.0.0.1"}}
+	state := &ClusterState{
+		masters: []*NodeState{master},
+		slaves:  map[string]*NodeState{"node-2": direct, "node-3": cascaded, "node-4": foreign},
+	}
+	lookupHost := func(host string) ([]string, error) {
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	state.resolveUpstreams(lookupHost)
+	assert.Equal(t, master, state.upstreamOf(direct))
+	assert.Equal(t, direct, state.upstreamOf(cascaded))
+	assert.Nil(t, state.upstreamOf(foreign))
+
+	lag := calculateUpstreamLag(*master, *direct)
+	assert.Equal(t, uint64(100), lag.receiveLag)
+	assert.Equal(t, uint64(200), lag.replayLag)
+
+	// the cascading standby streams what it has received
+	lag = calculateUpstreamLag(*direct, *cascaded)
+	assert.Equal(t, uint64(50), lag.receiveLag)
+	assert.Equal(t, uint64(50), lag.replayLag)
+}
+
+func TestClusterState_upstreamsByAddress(t *testing.T) {
+	master := &NodeState{host: "node-1"}
+	// primary_conninfo points at the upstream's IP address, the nodes are configured by name
+	direct := &NodeState{host: "node-2", isInRecovery: true, walReceiver: &WalReceiverState{senderHost: "10.0.0.1"}}
+	cascaded := &NodeState{host: "node-3", isInRecovery: true, walReceiver: &WalReceiverState{senderHost: "10.0.0.2"}}
+	// another name of the upstream
+	aliased := &NodeState{host: "node-4", isInRecovery: true, walReceiver: &WalReceiverState{senderHost: "db-2.example.com"}}
+	// an IPv6 address written differently
+	ipv6 := &NodeState{host: "2001:db8::5", isInRecovery: true, walReceiver: &WalReceiverState{senderHost: "2001:0db8:0000::0002"}}
+	unknown := &NodeState{host: "node-6", isInRecovery: true, walReceiver: &WalReceiverState{senderHost: "10.0.0.9"}}
+	state := &ClusterState{
+		masters: []*NodeState{master},
+		slaves:  map[string]*NodeState{"node-2": direct, "node-3": cascaded, "node-4": aliased, "2001:db8::5": ipv6, "node-6": unknown},
+	}
+	resolved := map[string][]string{"node-1": {"10.0.0.1"}, "node-2": {"10.0.0.2", "2001:db8::2"}, "db-2.example.com": {"10.0.0.2"}}
+	state.resolveUpstreams(func(host string) ([]string, error) {
+		if addresses, found := resolved[host]; found {
+			return addresses, nil
+		}
+		return nil, fmt.Errorf("no such host %s", host)
+	})
+	assert.Equal(t, master, state.upstreamOf(direct))
+	assert.Equal(t, direct, state.upstreamOf(cascaded))
+	assert.Equal(t, direct, state.upstreamOf(aliased))
+	assert.Equal(t, direct, state.upstreamOf(ipv6))
+	assert.Nil(t, state.upstreamOf(unknown))
+}
+
+func TestClusterState_separateForeign(t *testing.T) {
+	master := &NodeState{host: "node-1", systemIdentifier: "7001"}
+	standalone := &NodeState{host: "node-2", systemIdentifier: "7002"}
+	slave := &NodeState{host: "node-3", isInRecovery: true, systemIdentifier: "7001"}
+	restored := &NodeState{host: "node-4", isInRecovery: true, systemIdentifier: "7003"}
+	unknown := &NodeState{host: "node-5", isInRecovery: true}
+	state := &ClusterState{
+		masters: []*NodeState{master, standalone},
+		slaves:  map[string]*NodeState{"node-3": slave, "node-4": restored, "node-5": unknown},
+	}
+	assert.Equal(t, "7001", state.systemIdentifier())
+	state.separateForeign()
+	assert.Equal(t, []*NodeState{master}, state.masters)
+	assert.False(t, state.isSplitBrain())
+	assert.Equal(t, map[string]*NodeState{"node-3": slave, "node-5": unknown}, state.slaves)
+	assert.Equal(t, map[string]*NodeState{"node-2": standalone, "node-4": restored}, state.foreign)
+	assert.Len(t, state.all(), 5)
+
+	// the single master's identifier wins even if most of the standbys share another one
+	mistyped := &NodeState{host: "node-6", isInRecovery: true, systemIdentifier: "7003"}
+	state = &ClusterState{masters: []*NodeState{master}, slaves: map[string]*NodeState{"node-4": restored, "node-6": mistyped}}
+	assert.Equal(t, "7001", state.systemIdentifier())
+	state.separateForeign()
+	assert.Equal(t, []*NodeState{master}, state.masters)
+	assert.Empty(t, state.slaves)
+	assert.Len(t, state.foreign, 2)
+	// during a split-brain a tie is won by the master
+	state = &ClusterState{masters: []*NodeState{master, {host: "node-7", systemIdentifier: "7003"}}}
+	assert.Equal(t, "7001", state.systemIdentifier())
+	// and the majority wins otherwise
+	state = &ClusterState{masters: []*NodeState{master, {host: "node-7", systemIdentifier: "7003"}}, slaves: map[string]*NodeState{"node-4": restored}}
+	assert.Equal(t, "7003", state.systemIdentifier())
+	// unknown identifiers (PostgreSQL 9.5) are trusted
+	state = &ClusterState{masters: []*NodeState{{host: "node-1"}}, slaves: map[string]*NodeState{"node-5": unknown}}
+	state.separateForeign()
+	assert.Len(t, state.slaves, 1)
+	assert.Empty(t, state.foreign)
+}
+
+func TestCluster_setHosts(t *testing.T) {
+	cluster := NewCluster(nil, "test", []string{"node-1", "node-2"}, 0, 0)
+	node := cluster.nodes["node-1"]
+	cluster.roleTracker.masters["node-2"] = true
+
+	added, removed := cluster.setHosts([]string{"node-1", "node-3"})
+	assert.Equal(t, []string{"node-3"}, added)
+	assert.Equal(t, []string{"node-2"}, removed)
+	assert.Same(t, node, cluster.nodes["node-1"])
+	assert.Len(t, cluster.nodes, 2)
+	assert.NotContains(t, cluster.roleTracker.masters, "node-2")
+
+	added, removed = cluster.setHosts([]string{"node-1", "node-3"})
+	assert.Empty(t, added)
+	assert.Empty(t, removed)
+}
+
+// fakeDriver answers the nodes' queries without a server, fakeNodes maps the hosts to their behaviour
+type fakeDriver struct{}
+
+// fakeNode is a PostgreSQL 16 master or standby, a hung one answers nothing until the query is cancelled,
+// a malformed one misses a column of the state
+type fakeNode struct {
+	isStandby bool
+	hung      bool
+	malformed bool
+}
+
+type fakeConn struct {
+	node *fakeNode
+}
+
+type fakeRows struct {
+	rows [][]string
+}
+
+var fakeNodes sync.Map
+
+func init() {
+	sql.Register("fake", fakeDriver{})
+}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	for _, field := range strings.Fields(name) {
+		if host, found := strings.CutPrefix(field, "host="); found {
+			if node, ok := fakeNodes.Load(host); ok {
+				return &fakeConn{node: node.(*fakeNode)}, nil
+			}
+			return nil, fmt.Errorf("unknown host %s", host)
+		}
+	}
+	return nil, fmt.Errorf("no host in %s", name)
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if c.node.hung {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return &fakeRows{rows: c.node.answer(query)}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, _ string, _ []driver.NamedValue) (driver.Result, error) {
+	if c.node.hung {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (n *fakeNode) answer(query string) [][]string {
+	clock := strconv.FormatFloat(float64(time.Now().UnixNano())/1e9, 'f', 6, 64)
+	switch {
+	case strings.Contains(query, "server_version_num"):
+		return [][]string{{"160002", "16.2"}}
+	case strings.Contains(query, "pg_control_system"):
+		return [][]string{{"7000000000000000001"}}
+	case strings.Contains(query, "pg_is_in_recovery") && n.malformed:
+		return [][]string{{"false", "0/3000000", "0/0", "0/0", "", clock, ""}}
+	case strings.Contains(query, "pg_is_in_recovery") && n.isStandby:
+		return [][]string{{"true", "0/0", "0/3000000", "0/3000000", "0.5", clock, "", ""}}
+	case strings.Contains(query, "pg_is_in_recovery"):
+		return [][]string{{"false", "0/3000000", "0/0", "0/0", "", clock, "", "000000010000000000000003"}}
+	case strings.Contains(query, "pg_control_checkpoint"):
+		return [][]string{{"1"}}
+	case strings.Contains(query, "pg_current_wal_lsn"):
+		return [][]string{{"0/3000000"}}
+	}
+	// pg_stat_replication, pg_replication_slots, pg_stat_wal_receiver
+	return nil
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	for i, value := range r.rows[0] {
+		dest[i] = value
+	}
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestCluster_queryForStateTimeout(t *testing.T) {
+	nodes := map[string]*fakeNode{"timeout-1": {}, "timeout-2": {isStandby: true}, "timeout-3": {hung: true}, "timeout-4": {hung: true}}
+	for host, node := range nodes {
+		fakeNodes.Store(host, node)
+	}
+	measurer := NewMeasurer(NewMetrics(prometheus.NewRegistry(), nil), "test", nil)
+	config := &ClusterConfig{User: "monitor", Password: "secret", MaxOpenConns: 1}
+	for host := range nodes {
+		config.Nodes = append(config.Nodes, &NodeConfig{Host: host})
+	}
+	dataSource := NewDataSource(measurer, config)
+	dataSource.driverName = "fake"
+	defer dataSource.close()
+	timeout := 200 * time.Millisecond
+	cluster := NewCluster(dataSource, "test", config.hosts(), timeout, 10)
+
+	start := time.Now()
+	state, err := cluster.queryForState()
+	// the hung nodes are waited for concurrently
+	assert.Less(t, time.Since(start), 2*timeout)
+	assert.NoError(t, err)
+	assert.Len(t, state.masters, 1)
+	assert.Equal(t, "timeout-1", state.masters[0].host)
+	assert.Contains(t, state.slaves, "timeout-2")
+	assert.Len(t, state.failed, 2)
+	for _, host := range []string{"timeout-3", "timeout-4"} {
+		assert.True(t, state.failed[host].timedOut)
+		assert.ErrorIs(t, state.failed[host].err, context.DeadlineExceeded)
+		assert.GreaterOrEqual(t, state.failed[host].collectionDuration, timeout)
+	}
+	assert.False(t, state.masters[0].timedOut)
+	assert.False(t, state.slaves["timeout-2"].timedOut)
+
+	updateClusterMetrics(cluster, measurer, state)
+	_, err = cluster.queryForState()
+	assert.NoError(t, err)
+	updateClusterMetrics(cluster, measurer, cluster.getLastState())
+	timeouts := func(host string) float64 {
+		return testutil.ToFloat64(measurer.nodeCollectionTimeoutsTotal.With(measurer.labels(prometheus.Labels{hostLabel: host})))
+	}
+	assert.Equal(t, float64(2), timeouts("timeout-3"))
+	assert.Equal(t, float64(2), timeouts("timeout-4"))
+	assert.Equal(t, float64(0), timeouts("timeout-1"))
+	assert.Equal(t, 4, testutil.CollectAndCount(measurer.nodeCollectionSeconds))
+	hungSeconds := testutil.ToFloat64(measurer.nodeCollectionSeconds.With(measurer.labels(prometheus.Labels{hostLabel: "timeout-3"})))
+	assert.GreaterOrEqual(t, hungSeconds, timeout.Seconds())
+	assert.Equal(t, float64(1), testutil.ToFloat64(measurer.nodeUp.With(measurer.labels(prometheus.Labels{hostLabel: "timeout-2"}))))
+	assert.Equal(t, float64(0), testutil.ToFloat64(measurer.nodeUp.With(measurer.labels(prometheus.Labels{hostLabel: "timeout-3"}))))
+	assert.Equal(t, float64(2), testutil.ToFloat64(measurer.nodeCollectionErrorsTotal.With(measurer.labels(prometheus.Labels{hostLabel: "timeout-3", categoryLabel: "timeout"}))))
+}
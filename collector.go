@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+// Describe sends no descriptors, the Measurer is an unchecked collector: every cluster
+// exports the same metrics, which the registry would reject as duplicates
+func (m *Measurer) Describe(chan<- *prometheus.Desc) {
+}
+
+// Collect refreshes the cluster's metrics unless they are younger than the minimum refresh period,
+// concurrent scrapes wait for the same refresh and share its results
+func (m *Measurer) Collect(ch chan<- prometheus.Metric) {
+	m.refreshMutex.Lock()
+	if time.Since(m.refreshedAt) >= m.minRefresh {
+		m.refresh()
+		m.refreshedAt = time.Now()
+	}
+	age := time.Since(m.refreshedAt).Seconds()
+	m.refreshMutex.Unlock()
+	for _, vec := range m.vecs {
+		vec.Collect(ch)
+	}
+	ch <- prometheus.MustNewConstMetric(m.sampleAgeSeconds, prometheus.GaugeValue, age, m.labelValues()...)
+}
+
+// labelValues returns the cluster name and the cluster's extra label values in the order of the label names
+func (m *Measurer) labelValues() []string {
+	m.labelsMutex.RLock()
+	defer m.labelsMutex.RUnlock()
+	values := []string{m.clusterName}
+	for _, name := range m.extraLabelNames {
+		values = append(values, m.clusterLabels[name])
+	}
+	return values
+}
+
+// Describe sends no descriptors, see Measurer.Describe
+func (e *Exporter) Describe(chan<- *prometheus.Desc) {
+}
+
+// Collect collects all the clusters concurrently, so a scrape takes as long as the slowest cluster's collection
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.mutex.Lock()
+	measurers := make([]*Measurer, 0, len(e.runners))
+	for _, r := range e.runners {
+		measurers = append(measurers, r.measurer)
+	}
+	e.mutex.Unlock()
+	var wg sync.WaitGroup
+	for _, measurer := range measurers {
+		wg.Add(1)
+		go func(measurer *Measurer) {
+			defer wg.Done()
+			measurer.Collect(ch)
+		}(measurer)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMeasurer_Collect(t *testing.T) {
+	measurer := NewMeasurer(NewMetrics(prometheus.NewRegistry(), nil), "test", nil)
+	refreshes := 0
+	measurer.refresh = func() {
+		refreshes++
+		measurer.set(measurer.primaries, measurer.labels(prometheus.Labels{}), 1)
+	}
+	measurer.minRefresh = time.Hour
+
+	assert.Equal(t, 2, testutil.CollectAndCount(measurer))
+	assert.Equal(t, 2, testutil.CollectAndCount(measurer, "pgrc_cluster_primaries", "pgrc_sample_age_seconds"))
+	assert.Equal(t, 1, refreshes)
+
+	measurer.minRefresh = 0
+	testutil.CollectAndCount(measurer)
+	assert.Equal(t, 2, refreshes)
+}
+
+func TestMeasurer_setClusterLabels(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry(), []string{"env"})
+	measurer := NewMeasurer(metrics, "test", map[string]string{"env": "dev"})
+	measurer.refresh = func() {}
+	measurer.set(measurer.primaries, measurer.labels(prometheus.Labels{}), 1)
+
+	// the heartbeat task and the scrapes read the labels while a reload replaces them
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			measurer.updateQueryStats("node-1", "SELECT 1", 1, true)
+			testutil.CollectAndCount(measurer)
+		}
+		done <- true
+	}()
+	measurer.setClusterLabels(map[string]string{"env": "prod"})
+	<-done
+
+	measurer.setClusterLabels(map[string]string{"env": "prod"})
+	assert.Equal(t, 0, testutil.CollectAndCount(metrics.primaries))
+	measurer.set(measurer.primaries, measurer.labels(prometheus.Labels{}), 1)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.primaries.WithLabelValues("test", "prod")))
+	assert.Equal(t, []string{"test", "prod"}, measurer.labelValues())
+}
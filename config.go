@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"regexp"
+	"sort"
+)
+
+// Config describes all the clusters monitored by the process, it comes either from the YAML file (--config)
+// or from the command line options (a single cluster)
+type Config struct {
+	Clusters []*ClusterConfig `yaml:"clusters"`
+	// credentials of the clusters probed on demand (/probe?auth_module=...)
+	AuthModules map[string]*AuthModule `yaml:"auth_modules"`
+}
+
+// AuthModule describes how to connect to the probed nodes, empty values are inherited from the defaults
+type AuthModule struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Port     string `yaml:"port"`
+	DBName   string `yaml:"dbname"`
+	SSLMode  string `yaml:"sslmode"`
+}
+
+type ClusterConfig struct {
+	Name string `yaml:"name"`
+	// extra labels added to all the cluster's metrics
+	Labels   map[string]string `yaml:"labels"`
+	Nodes    []*NodeConfig     `yaml:"nodes"`
+	Port     string            `yaml:"port"`
+	DBName   string            `yaml:"dbname"`
+	SSLMode  string            `yaml:"sslmode"`
+	User     string            `yaml:"user"`
+	Password string            `yaml:"password"`
+	// seconds
+	Interval          int64  `yaml:"interval"`
+	NodeTimeout       int64  `yaml:"node_timeout"`
+	LsnHistorySize    int    `yaml:"lsn_history_size"`
+	HeartbeatTable    string `yaml:"heartbeat_table"`
+	HeartbeatInterval int64  `yaml:"heartbeat_interval"`
+	// connection pool of every node, lifetimes in seconds, 0 means unlimited
+	MaxOpenConns    int   `yaml:"max_open_conns"`
+	MaxIdleConns    int   `yaml:"max_idle_conns"`
+	ConnMaxLifetime int64 `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime int64 `yaml:"conn_max_idle_time"`
+	// the standbys streaming from the master are added to the nodes, client_addr or application_name -> host;
+	// a discovered standby missing from pg_stat_replication for more than DiscoveryExpiry collections is removed
+	Discovery       bool              `yaml:"discovery"`
+	HostMapping     map[string]string `yaml:"host_mapping"`
+	DiscoveryExpiry int               `yaml:"discovery_expiry"`
+	// keys set in the config file, even to a zero value, the other ones are inherited from the defaults
+	keys map[string]bool
+}
+
+// UnmarshalYAML decodes the cluster and records its keys, so `discovery: false` or `heartbeat_table: ""`
+// overrides the defaults
+func (c *ClusterConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain ClusterConfig
+	if err := value.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	c.keys = make(map[string]bool)
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		c.keys[value.Content[i].Value] = true
+	}
+	return nil
+}
+
+// isSet tells if the key is set in the config file
+func (c *ClusterConfig) isSet(key string) bool {
+	return c.keys[key]
+}
+
+// NodeConfig describes how to connect to a node, empty values are inherited from the cluster
+type NodeConfig struct {
+	Host    string `yaml:"host"`
+	Port    string `yaml:"port"`
+	DBName  string `yaml:"dbname"`
+	SSLMode string `yaml:"sslmode"`
+}
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func loadConfig(path string, defaults *ClusterConfig) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	config := &Config{}
+	if err = yaml.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	config.applyDefaults(defaults)
+	if err = config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+func (config *Config) applyDefaults(defaults *ClusterConfig) {
+	for _, a := range config.AuthModules {
+		if a == nil {
+			continue
+		}
+		if a.User == "" {
+			a.User = defaults.User
+		}
+		if a.Password == "" {
+			a.Password = defaults.Password
+		}
+		if a.Port == "" {
+			a.Port = defaults.Port
+		}
+		if a.DBName == "" {
+			a.DBName = defaults.DBName
+		}
+		if a.SSLMode == "" {
+			a.SSLMode = defaults.SSLMode
+		}
+	}
+	for _, c := range config.Clusters {
+		if !c.isSet("port") {
+			c.Port = defaults.Port
+		}
+		if !c.isSet("dbname") {
+			c.DBName = defaults.DBName
+		}
+		if !c.isSet("sslmode") {
+			c.SSLMode = defaults.SSLMode
+		}
+		if !c.isSet("user") {
+			c.User = defaults.User
+		}
+		if !c.isSet("password") {
+			c.Password = defaults.Password
+		}
+		if !c.isSet("interval") {
+			c.Interval = defaults.Interval
+		}
+		if !c.isSet("node_timeout") {
+			c.NodeTimeout = defaults.NodeTimeout
+		}
+		if !c.isSet("lsn_history_size") {
+			c.LsnHistorySize = defaults.LsnHistorySize
+		}
+		if !c.isSet("heartbeat_table") {
+			c.HeartbeatTable = defaults.HeartbeatTable
+		}
+		if !c.isSet("heartbeat_interval") {
+			c.HeartbeatInterval = defaults.HeartbeatInterval
+		}
+		if !c.isSet("max_open_conns") {
+			c.MaxOpenConns = defaults.MaxOpenConns
+		}
+		if !c.isSet("max_idle_conns") {
+			c.MaxIdleConns = defaults.MaxIdleConns
+		}
+		if !c.isSet("conn_max_lifetime") {
+			c.ConnMaxLifetime = defaults.ConnMaxLifetime
+		}
+		if !c.isSet("conn_max_idle_time") {
+			c.ConnMaxIdleTime = defaults.ConnMaxIdleTime
+		}
+		if !c.isSet("discovery") {
+			c.Discovery = defaults.Discovery
+		}
+		if !c.isSet("discovery_expiry") {
+			c.DiscoveryExpiry = defaults.DiscoveryExpiry
+		}
+		for _, n := range c.Nodes {
+			if n.Port == "" {
+				n.Port = c.Port
+			}
+			if n.DBName == "" {
+				n.DBName = c.DBName
+			}
+			if n.SSLMode == "" {
+				n.SSLMode = c.SSLMode
+			}
+		}
+		if c.Name == "" {
+			c.Name = clusterHash(c.hosts())
+		}
+	}
+}
+
+func (config *Config) validate() error {
+	if len(config.Clusters) == 0 && len(config.AuthModules) == 0 {
+		return fmt.Errorf("no clusters nor auth modules defined")
+	}
+	for name, a := range config.AuthModules {
+		if a == nil || a.User == "" || a.Password == "" {
+			return fmt.Errorf("auth module `%s`: user and password are mandatory", name)
+		}
+	}
+	names := make(map[string]bool)
+	for _, c := range config.Clusters {
+		if names[c.Name] {
+			return fmt.Errorf("duplicated cluster name `%s`", c.Name)
+		}
+		names[c.Name] = true
+		if c.User == "" || c.Password == "" {
+			return fmt.Errorf("cluster `%s`: user and password are mandatory", c.Name)
+		}
+		if c.Discovery && len(c.Nodes) < 1 {
+			return fmt.Errorf("cluster `%s`: no seed nodes to discover from", c.Name)
+		}
+		if !c.Discovery && len(c.Nodes) < 2 {
+			return fmt.Errorf("cluster `%s`: nodes count is less than 2", c.Name)
+		}
+		if c.Discovery && c.DiscoveryExpiry < 1 {
+			return fmt.Errorf("cluster `%s`: discovery expiry must be positive", c.Name)
+		}
+		for address := range c.HostMapping {
+			if address == "" {
+				return fmt.Errorf("cluster `%s`: host mapping address is mandatory", c.Name)
+			}
+		}
+		if c.Interval <= 0 || c.NodeTimeout <= 0 {
+			return fmt.Errorf("cluster `%s`: interval and node timeout must be positive", c.Name)
+		}
+		if c.MaxOpenConns < 1 || c.MaxIdleConns < 0 || c.ConnMaxLifetime < 0 || c.ConnMaxIdleTime < 0 {
+			return fmt.Errorf("cluster `%s`: max open connections must be positive, other pool settings can't be negative", c.Name)
+		}
+		hosts := make(map[string]bool)
+		for _, n := range c.Nodes {
+			if n.Host == "" {
+				return fmt.Errorf("cluster `%s`: node host is mandatory", c.Name)
+			}
+			if hosts[n.Host] {
+				return fmt.Errorf("cluster `%s`: duplicated node host `%s`", c.Name, n.Host)
+			}
+			hosts[n.Host] = true
+		}
+		for name := range c.Labels {
+			if !labelNameRegexp.MatchString(name) || reservedLabelNames[name] {
+				return fmt.Errorf("cluster `%s`: invalid label name `%s`", c.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// labelNames returns the sorted union of the clusters' extra label names, all the metrics have them
+func (config *Config) labelNames() []string {
+	set := make(map[string]bool)
+	for _, c := range config.Clusters {
+		for name := range c.Labels {
+			set[name] = true
+		}
+	}
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *ClusterConfig) hosts() []string {
+	hosts := make([]string, 0, len(c.Nodes))
+	for _, n := range c.Nodes {
+		hosts = append(hosts, n.Host)
+	}
+	return hosts
+}
+
+// probeClusterConfig returns a config of the cluster probed with the auth module's credentials
+func (a *AuthModule) probeClusterConfig(name string, hosts []string, defaults *ClusterConfig) *ClusterConfig {
+	c := &ClusterConfig{
+		Name:        name,
+		Port:        a.Port,
+		DBName:      a.DBName,
+		SSLMode:     a.SSLMode,
+		User:        a.User,
+		Password:    a.Password,
+		NodeTimeout: defaults.NodeTimeout,
+		// a probe runs a single collection
+		MaxOpenConns: 1,
+		MaxIdleConns: 1,
+	}
+	for _, host := range hosts {
+		c.Nodes = append(c.Nodes, &NodeConfig{Host: host, Port: c.Port, DBName: c.DBName, SSLMode: c.SSLMode})
+	}
+	return c
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfig_loadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	err := os.WriteFile(path, []byte(`
+clusters:
+  - name: orders
+    user: monitor
+    password: secret
+    interval: 30
+    labels:
+      env: prod
+    nodes:
+      - host: orders-1
+      - host: orders-2
+        port: "5433"
+        sslmode: require
+  - user: monitor
+    password: secret
+    labels:
+      team: billing
+    nodes:
+      - host: billing-1
+      - host: billing-2
+`), 0600)
+	assert.NoError(t, err)
+
+	defaults := &ClusterConfig{Port: "6432", DBName: "postgres", SSLMode: "disable", Interval: 15, NodeTimeout: 10, LsnHistorySize: 240, MaxOpenConns: 2, MaxIdleConns: 1}
+	config, err := loadConfig(path, defaults)
+	assert.NoError(t, err)
+	assert.Len(t, config.Clusters, 2)
+
+	orders := config.Clusters[0]
+	assert.Equal(t, int64(30), orders.Interval)
+	assert.Equal(t, int64(10), orders.NodeTimeout)
+	assert.Equal(t, "6432", orders.Nodes[0].Port)
+	assert.Equal(t, "disable", orders.Nodes[0].SSLMode)
+	assert.Equal(t, "5433", orders.Nodes[1].Port)
+	assert.Equal(t, "require", orders.Nodes[1].SSLMode)
+
+	billing := config.Clusters[1]
+	assert.Equal(t, clusterHash([]string{"billing-1", "billing-2"}), billing.Name)
+	assert.Equal(t, int64(15), billing.Interval)
+
+	assert.Equal(t, []string{"env", "team"}, config.labelNames())
+}
+
+func TestConfig_loadConfigExplicitZeros(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	err := os.WriteFile(path, []byte(`
+clusters:
+  - name: orders
+    user: monitor
+    password: secret
+    heartbeat_table: ""
+    discovery: false
+    max_idle_conns: 0
+    conn_max_lifetime: 0
+    nodes:
+      - host: orders-1
+      - host: orders-2
+  - name: billing
+    user: monitor
+    password: secret
+    node_timeout: 0
+    nodes:
+      - host: billing-1
+      - host: billing-2
+`), 0600)
+	assert.NoError(t, err)
+
+	defaults := &ClusterConfig{Port: "6432", DBName: "postgres", SSLMode: "disable", Interval: 15, NodeTimeout: 10, LsnHistorySize: 240,
+		HeartbeatTable: "public.heartbeat", HeartbeatInterval: 1, MaxOpenConns: 2, MaxIdleConns: 1, ConnMaxLifetime: 300,
+		Discovery: true, DiscoveryExpiry: 10}
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	config := &Config{}
+	assert.NoError(t, yaml.Unmarshal(content, config))
+	config.applyDefaults(defaults)
+
+	orders := config.Clusters[0]
+	assert.Equal(t, "", orders.HeartbeatTable)
+	assert.False(t, orders.Discovery)
+	assert.Equal(t, 0, orders.MaxIdleConns)
+	assert.Equal(t, int64(0), orders.ConnMaxLifetime)
+	// the omitted keys are inherited
+	assert.Equal(t, int64(10), orders.NodeTimeout)
+	assert.Equal(t, 2, orders.MaxOpenConns)
+	assert.Equal(t, 10, orders.DiscoveryExpiry)
+
+	billing := config.Clusters[1]
+	assert.Equal(t, int64(0), billing.NodeTimeout)
+	assert.Equal(t, "public.heartbeat", billing.HeartbeatTable)
+	assert.True(t, billing.Discovery)
+
+	// an explicit zero timeout isn't replaced by the default, it is rejected
+	_, err = loadConfig(path, defaults)
+	assert.ErrorContains(t, err, "cluster `billing`: interval and node timeout must be positive")
+}
+
+func TestConfig_validate(t *testing.T) {
+	newConfig := func() *Config {
+		return &Config{Clusters: []*ClusterConfig{{
+			Name: "test", User: "monitor", Password: "secret", Interval: 15, NodeTimeout: 10, MaxOpenConns: 2,
+			Nodes: []*NodeConfig{{Host: "node-1"}, {Host: "node-2"}},
+		}}}
+	}
+	assert.NoError(t, newConfig().validate())
+
+	config := newConfig()
+	config.Clusters[0].Nodes[1].Host = "node-1"
+	assert.Error(t, config.validate())
+
+	config = newConfig()
+	config.Clusters[0].Labels = map[string]string{hostLabel: "x"}
+	assert.Error(t, config.validate())
+
+	config = newConfig()
+	config.Clusters[0].MaxOpenConns = 0
+	assert.Error(t, config.validate())
+
+	config = newConfig()
+	config.Clusters = append(config.Clusters, newConfig().Clusters[0])
+	assert.Error(t, config.validate())
+
+	// a single seed node is enough to discover the others
+	config = newConfig()
+	config.Clusters[0].Nodes = config.Clusters[0].Nodes[:1]
+	assert.Error(t, config.validate())
+	config.Clusters[0].Discovery = true
+	assert.Error(t, config.validate())
+	config.Clusters[0].DiscoveryExpiry = 10
+	assert.NoError(t, config.validate())
+	config.Clusters[0].HostMapping = map[string]string{"": "node-2"}
+	assert.Error(t, config.validate())
+}
+
+func TestConfig_authModules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	err := os.WriteFile(path, []byte(`
+auth_modules:
+  monitor:
+    user: monitor
+    password: secret
+    port: "5432"
+`), 0600)
+	assert.NoError(t, err)
+
+	defaults := &ClusterConfig{Port: "6432", DBName: "postgres", SSLMode: "disable", NodeTimeout: 10}
+	config, err := loadConfig(path, defaults)
+	assert.NoError(t, err)
+	assert.Empty(t, config.Clusters)
+
+	probed := config.AuthModules["monitor"].probeClusterConfig("probed", []string{"node-1", "node-2"}, defaults)
+	assert.Equal(t, "monitor", probed.User)
+	assert.Equal(t, int64(10), probed.NodeTimeout)
+	assert.Equal(t, "5432", probed.Nodes[1].Port)
+	assert.Equal(t, "disable", probed.Nodes[1].SSLMode)
+
+	config.AuthModules["monitor"].Password = ""
+	assert.Error(t, config.validate())
+}
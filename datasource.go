@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -14,90 +16,296 @@ type DataSource struct {
 	user       string
 	password   string
 	sslMode    string
+	// per host connection settings, the defaults above are used for hosts not configured explicitly
+	nodes map[string]*NodeConfig
+	// pool settings of every host's handle
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+	connMaxIdleTime time.Duration
+	// nodes are queried concurrently, the mutex guards the connection map
+	mutex      sync.Mutex
 	connection map[string]*sql.DB
+	// pool totals of the handles closed so far, so the totals don't drop on reconnects
+	retired map[string]sql.DBStats
 }
 
-func NewDataSource(measurer *Measurer, port, user, password string) *DataSource {
-	return &DataSource{
+func NewDataSource(measurer *Measurer, config *ClusterConfig) *DataSource {
+	db := &DataSource{
 		measurer:   measurer,
 		driverName: "postgres",
-		port:       port,
-		dbname:     "postgres",
-		user:       user,
-		password:   password,
-		sslMode:    "disable",
 		connection: make(map[string]*sql.DB),
+		retired:    make(map[string]sql.DBStats),
 	}
+	db.configure(config, config.hosts())
+	return db
+}
+
+// configure applies the cluster's connection settings, the connections of the hosts missing from the given ones
+// (the configured and the discovered nodes) are removed, the ones whose settings have changed are closed
+func (db *DataSource) configure(config *ClusterConfig, hosts []string) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	previous := make(map[string]string)
+	for host := range db.connection {
+		previous[host] = db.connectionString(host)
+	}
+	db.port = config.Port
+	db.dbname = config.DBName
+	db.user = config.User
+	db.password = config.Password
+	db.sslMode = config.SSLMode
+	db.nodes = make(map[string]*NodeConfig)
+	for _, node := range config.Nodes {
+		db.nodes[node.Host] = node
+	}
+	db.maxOpenConns = config.MaxOpenConns
+	db.maxIdleConns = config.MaxIdleConns
+	db.connMaxLifetime = time.Duration(config.ConnMaxLifetime) * time.Second
+	db.connMaxIdleTime = time.Duration(config.ConnMaxIdleTime) * time.Second
+	kept := make(map[string]bool)
+	for _, host := range hosts {
+		kept[host] = true
+	}
+	for host, conn := range db.connection {
+		if !kept[host] {
+			db.removeConnection(host)
+		} else if db.connectionString(host) != previous[host] {
+			db.closeConnection(host)
+			delete(db.connection, host)
+		} else if conn != nil {
+			db.configurePool(conn)
+		}
+	}
+}
+
+// configurePool applies the pool settings, it is safe to call on a handle in use
+func (db *DataSource) configurePool(conn *sql.DB) {
+	conn.SetMaxOpenConns(db.maxOpenConns)
+	conn.SetMaxIdleConns(db.maxIdleConns)
+	conn.SetConnMaxLifetime(db.connMaxLifetime)
+	conn.SetConnMaxIdleTime(db.connMaxIdleTime)
+}
+
+// stats returns the pool statistics of every open host's handle, the cumulative ones include the closed handles
+func (db *DataSource) stats() map[string]sql.DBStats {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	stats := make(map[string]sql.DBStats)
+	for host, conn := range db.connection {
+		if conn != nil {
+			current := conn.Stats()
+			totals := addPoolTotals(db.retired[host], current)
+			current.WaitCount, current.WaitDuration = totals.WaitCount, totals.WaitDuration
+			current.MaxIdleClosed, current.MaxIdleTimeClosed, current.MaxLifetimeClosed = totals.MaxIdleClosed, totals.MaxIdleTimeClosed, totals.MaxLifetimeClosed
+			stats[host] = current
+		}
+	}
+	return stats
+}
+
+// close closes all the connections
+func (db *DataSource) close() {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for host := range db.connection {
+		db.closeConnection(host)
+		delete(db.connection, host)
+	}
+}
+
+// closeConnection closes the host's handle and keeps its pool totals, the mutex has to be held
+func (db *DataSource) closeConnection(host string) {
+	conn := db.connection[host]
+	if conn == nil {
+		return
+	}
+	db.retired[host] = addPoolTotals(db.retired[host], conn.Stats())
+	_ = conn.Close()
+	db.connection[host] = nil
+}
+
+// removeConnection closes the removed host's handle and forgets its pool totals, the mutex has to be held
+func (db *DataSource) removeConnection(host string) {
+	db.closeConnection(host)
+	delete(db.connection, host)
+	delete(db.retired, host)
+}
+
+// addPoolTotals adds the cumulative statistics of the handle to the totals
+func addPoolTotals(totals sql.DBStats, stats sql.DBStats) sql.DBStats {
+	totals.WaitCount += stats.WaitCount
+	totals.WaitDuration += stats.WaitDuration
+	totals.MaxIdleClosed += stats.MaxIdleClosed
+	totals.MaxIdleTimeClosed += stats.MaxIdleTimeClosed
+	totals.MaxLifetimeClosed += stats.MaxLifetimeClosed
+	return totals
+}
+
+func (db *DataSource) connectionString(host string) string {
+	port, dbname, sslMode := db.port, db.dbname, db.sslMode
+	if node := db.nodes[host]; node != nil {
+		port, dbname, sslMode = node.Port, node.DBName, node.SSLMode
+	}
+	return fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=%s", host, port, dbname, db.user, db.password, sslMode)
 }
 
 func (db *DataSource) connect(host string, force bool) (*sql.DB, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
 	var err error
 	if db.connection[host] == nil || force {
-		cs := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=%s", host, db.port, db.dbname, db.user, db.password, db.sslMode)
-		db.connection[host], err = sql.Open(db.driverName, cs)
+		db.closeConnection(host)
+		db.connection[host], err = sql.Open(db.driverName, db.connectionString(host))
 		if err != nil {
 			db.connection[host] = nil
 			log.warn("Can't connect to %s, error: %v", host, err)
 			return nil, err
 		}
+		db.configurePool(db.connection[host])
 	}
 	return db.connection[host], nil
 }
 
-func (db *DataSource) reconnect(host string) (*sql.DB, error) {
+func (db *DataSource) disconnect(host string) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.closeConnection(host)
+}
+
+// remove closes the connection of a host which is no longer a node, e.g. an expired discovered standby
+func (db *DataSource) remove(host string) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.removeConnection(host)
+}
+
+func (db *DataSource) reconnect(ctx context.Context, host string) (*sql.DB, error) {
 	db.measurer.incReconnects(host)
-	var err error
-	_, err = db.connect(host, true)
+	conn, err := db.connect(host, true)
 	if err != nil {
-		db.connection[host] = nil
+		db.disconnect(host)
 		log.warn("Can't connect %s, error: %v", host, err)
 		return nil, err
 	} else {
-		err = db.connection[host].Ping()
+		err = conn.PingContext(ctx)
 		if err != nil {
-			db.connection[host] = nil
+			db.disconnect(host)
 			log.warn("Can't ping %s, error: %v", host, err)
 			return nil, err
 		}
 	}
-	return db.connection[host], nil
+	return conn, nil
 }
 
-func (db *DataSource) Ping(host string) (int64, error) {
+func (db *DataSource) Ping(ctx context.Context, host string) (int64, error) {
 	start := time.Now()
-	if db.connection[host] == nil {
+	db.mutex.Lock()
+	conn := db.connection[host]
+	db.mutex.Unlock()
+	if conn == nil {
 		return -1, fmt.Errorf("host %s is disconnected", host)
 	}
-	err := db.connection[host].Ping()
+	err := conn.PingContext(ctx)
 	return time.Since(start).Milliseconds(), err
 }
 
-func (db *DataSource) QueryStrWithEffort(host, q string) (string, error) {
+// shouldReconnect tells if the query could succeed on a new connection: not if it has timed out
+// or if the server has rejected the statement itself (e.g. a missing table or privilege)
+func shouldReconnect(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() == nil && !isStatementError(err)
+}
+
+func (db *DataSource) QueryStrWithEffort(ctx context.Context, host, q string) (string, error) {
 	log.debug("query: `%s`", q)
-	var err error
-	_, err = db.connect(host, false)
+	conn, err := db.connect(host, false)
 	if err != nil {
 		log.warn("Can't connect %s, error: %v", host, err)
 		return "", err
 	}
 	var v string
-	v, err = db.queryStr(host, q)
-	if err != nil {
-		_, err = db.reconnect(host)
+	v, err = db.queryStr(ctx, conn, host, q)
+	if shouldReconnect(ctx, err) {
+		conn, err = db.reconnect(ctx, host)
 		if err != nil {
 			log.warn("Can't connect %s, error: %v", host, err)
 			return "", err
 		} else {
-			v, err = db.queryStr(host, q)
+			v, err = db.queryStr(ctx, conn, host, q)
 		}
 	}
 	log.debug("query result: `%s`", v)
 	return v, err
 }
 
-func (db *DataSource) queryStr(host, q string) (string, error) {
+func (db *DataSource) QueryRowsWithEffort(ctx context.Context, host, q string) ([][]string, error) {
+	log.debug("query: `%s`", q)
+	conn, err := db.connect(host, false)
+	if err != nil {
+		log.warn("Can't connect %s, error: %v", host, err)
+		return nil, err
+	}
+	var rows [][]string
+	rows, err = db.queryRows(ctx, conn, host, q)
+	if shouldReconnect(ctx, err) {
+		conn, err = db.reconnect(ctx, host)
+		if err != nil {
+			log.warn("Can't connect %s, error: %v", host, err)
+			return nil, err
+		} else {
+			rows, err = db.queryRows(ctx, conn, host, q)
+		}
+	}
+	log.debug("query result: %d rows", len(rows))
+	return rows, err
+}
+
+// QueryRowWithEffort returns the first row of the result as strings, NULL values are returned as empty strings,
+// sql.ErrNoRows if the result is empty
+func (db *DataSource) QueryRowWithEffort(ctx context.Context, host, q string) ([]string, error) {
+	rows, err := db.QueryRowsWithEffort(ctx, host, q)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return rows[0], nil
+}
+
+func (db *DataSource) ExecWithEffort(ctx context.Context, host, q string) error {
+	log.debug("exec: `%s`", q)
+	conn, err := db.connect(host, false)
+	if err != nil {
+		log.warn("Can't connect %s, error: %v", host, err)
+		return err
+	}
+	err = db.exec(ctx, conn, host, q)
+	if shouldReconnect(ctx, err) {
+		conn, err = db.reconnect(ctx, host)
+		if err != nil {
+			log.warn("Can't connect %s, error: %v", host, err)
+			return err
+		} else {
+			err = db.exec(ctx, conn, host, q)
+		}
+	}
+	return err
+}
+
+func (db *DataSource) exec(ctx context.Context, conn *sql.DB, host, q string) error {
+	start := time.Now()
+	if _, err := conn.ExecContext(ctx, q); err != nil {
+		db.measurer.updateQueryStats(host, q, time.Since(start).Milliseconds(), false)
+		return err
+	}
+	db.measurer.updateQueryStats(host, q, time.Since(start).Milliseconds(), true)
+	return nil
+}
+
+func (db *DataSource) queryStr(ctx context.Context, conn *sql.DB, host, q string) (string, error) {
 	start := time.Now()
-	row := db.connection[host].QueryRow(q)
+	row := conn.QueryRowContext(ctx, q)
 	var v string
 	if err := row.Scan(&v); err != nil {
 		db.measurer.updateQueryStats(host, q, time.Since(start).Milliseconds(), false)
@@ -106,3 +314,45 @@ func (db *DataSource) queryStr(host, q string) (string, error) {
 	db.measurer.updateQueryStats(host, q, time.Since(start).Milliseconds(), true)
 	return v, nil
 }
+
+// queryRows returns all rows of the result as strings, NULL values are returned as empty strings
+func (db *DataSource) queryRows(ctx context.Context, conn *sql.DB, host, q string) ([][]string, error) {
+	start := time.Now()
+	rows, err := conn.QueryContext(ctx, q)
+	if err != nil {
+		db.measurer.updateQueryStats(host, q, time.Since(start).Milliseconds(), false)
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var result [][]string
+	if result, err = scanRows(rows); err != nil {
+		db.measurer.updateQueryStats(host, q, time.Since(start).Milliseconds(), false)
+		return nil, err
+	}
+	db.measurer.updateQueryStats(host, q, time.Since(start).Milliseconds(), true)
+	return result, nil
+}
+
+func scanRows(rows *sql.Rows) ([][]string, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var result [][]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := make([]string, len(columns))
+		for i, v := range values {
+			row[i] = v.String
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDataSource_configurePool(t *testing.T) {
+	measurer := NewMeasurer(NewMetrics(prometheus.NewRegistry(), nil), "test", nil)
+	config := &ClusterConfig{Port: "1", DBName: "postgres", SSLMode: "disable", User: "monitor", Password: "secret", MaxOpenConns: 2, MaxIdleConns: 1,
+		Nodes: []*NodeConfig{{Host: "node-1", Port: "1", DBName: "postgres", SSLMode: "disable"}}}
+	db := NewDataSource(measurer, config)
+	defer db.close()
+	// sql.Open doesn't connect yet
+	conn, err := db.connect("node-1", false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, conn.Stats().MaxOpenConnections)
+
+	// the pool settings are applied to the open handle, it is kept since the connection string hasn't changed
+	changed := *config
+	changed.MaxOpenConns = 4
+	db.configure(&changed, changed.hosts())
+	assert.Same(t, conn, db.connection["node-1"])
+	assert.Equal(t, 4, db.stats()["node-1"].MaxOpenConnections)
+
+	// the totals of the closed handles are kept
+	db.retired["node-1"] = sql.DBStats{WaitCount: 3, WaitDuration: time.Second, MaxIdleClosed: 1, MaxIdleTimeClosed: 2, MaxLifetimeClosed: 5}
+	_, err = db.connect("node-1", true)
+	assert.NoError(t, err)
+	stats := db.stats()["node-1"]
+	assert.Equal(t, int64(3), stats.WaitCount)
+	assert.Equal(t, time.Second, stats.WaitDuration)
+	assert.Equal(t, int64(5), stats.MaxLifetimeClosed)
+
+	// a discovered node's handle is kept
+	_, err = db.connect("10.0.0.3", false)
+	assert.NoError(t, err)
+	db.configure(&changed, []string{"node-1", "10.0.0.3"})
+	assert.Len(t, db.stats(), 2)
+
+	// a removed node's handle is closed and its totals are forgotten
+	changed.Nodes = nil
+	db.configure(&changed, changed.hosts())
+	assert.Empty(t, db.stats())
+	assert.Empty(t, db.retired)
+}
+
+func TestMeasurer_updatePoolStats(t *testing.T) {
+	measurer := NewMeasurer(NewMetrics(prometheus.NewRegistry(), nil), "test", nil)
+	labels := measurer.labels(prometheus.Labels{hostLabel: "node-1"})
+	measurer.updatePoolStats(map[string]sql.DBStats{"node-1": {OpenConnections: 2, MaxOpenConnections: 2, WaitCount: 3, WaitDuration: 2 * time.Second}})
+	measurer.updatePoolStats(map[string]sql.DBStats{"node-1": {OpenConnections: 1, MaxOpenConnections: 2, WaitCount: 5, WaitDuration: 3 * time.Second, MaxLifetimeClosed: 1}})
+	assert.Equal(t, float64(1), testutil.ToFloat64(measurer.poolOpenConnections.With(labels)))
+	assert.Equal(t, float64(5), testutil.ToFloat64(measurer.poolWaitCount.With(labels)))
+	assert.Equal(t, float64(3), testutil.ToFloat64(measurer.poolWaitSeconds.With(labels)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(measurer.poolMaxLifetimeClosed.With(labels)))
+
+	// a smaller total starts from zero, the counter never drops
+	measurer.updatePoolStats(map[string]sql.DBStats{"node-1": {WaitCount: 1}})
+	assert.Equal(t, float64(6), testutil.ToFloat64(measurer.poolWaitCount.With(labels)))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Discovery adds the standbys streaming from the master to the cluster, the configured nodes are the seeds
+type Discovery struct {
+	// client_addr or application_name -> host to connect to, an empty host ignores the standby
+	hostMapping map[string]string
+	// collections a discovered host may be missing from the masters' pg_stat_replication before it is removed
+	expireAfter int
+	// discovered host -> consecutive collections it has been missing, the hosts are kept across the reloads
+	discovered map[string]int
+	// resolves the nodes' hosts, a standby connected by its address may be a node configured by its name
+	lookupHost func(host string) ([]string, error)
+}
+
+func NewDiscovery(hostMapping map[string]string, expireAfter int) *Discovery {
+	return &Discovery{hostMapping: hostMapping, expireAfter: expireAfter, discovered: make(map[string]int), lookupHost: net.LookupHost}
+}
+
+// standbyHost returns the host the wal sender's standby is reachable at: the mapped application_name or client_addr,
+// or the client_addr itself; empty if the standby is ignored or connected through a unix socket
+func (d *Discovery) standbyHost(sender *WalSenderState) string {
+	if host, mapped := d.hostMapping[sender.applicationName]; mapped && sender.applicationName != "" {
+		return host
+	}
+	if host, mapped := d.hostMapping[sender.clientAddr]; mapped && sender.clientAddr != "" {
+		return host
+	}
+	return sender.clientAddr
+}
+
+// resolve returns the nodes' addresses, hosts which can't be resolved are skipped
+func (d *Discovery) resolve(nodes map[string]*Node) map[string]string {
+	hosts := make([]string, 0, len(nodes))
+	for host := range nodes {
+		hosts = append(hosts, host)
+	}
+	return resolveAddresses(d.lookupHost, hosts)
+}
+
+// resolveAddresses returns the hosts' addresses mapped to the hosts, an address is a host itself;
+// hosts which can't be resolved are skipped
+func resolveAddresses(lookupHost func(host string) ([]string, error), hosts []string) map[string]string {
+	addresses := make(map[string]string)
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			addresses[ip.String()] = host
+			continue
+		}
+		resolved, err := lookupHost(host)
+		if err != nil {
+			log.debug("can't resolve %s, error: %v", host, err)
+			continue
+		}
+		for _, address := range resolved {
+			addresses[address] = host
+		}
+	}
+	return addresses
+}
+
+// discover returns the sorted hosts of the masters' streaming standbys which aren't cluster nodes yet and the nodes
+// the masters stream to; a standby is a node if its mapped host, application_name or client_addr is the node's host,
+// or if its client_addr is the node's resolved address (resolved only if needed)
+func (d *Discovery) discover(state *ClusterState, nodes map[string]*Node) (added []string, present map[string]bool) {
+	var addresses map[string]string
+	found := make(map[string]bool)
+	present = make(map[string]bool)
+	for _, master := range state.masters {
+		for _, sender := range master.walSenders {
+			host := d.standbyHost(sender)
+			if host == "" {
+				continue
+			}
+			node := ""
+			for _, name := range []string{host, sender.applicationName, sender.clientAddr} {
+				if nodes[name] != nil {
+					node = name
+					break
+				}
+			}
+			if node == "" {
+				if addresses == nil {
+					addresses = d.resolve(nodes)
+				}
+				node = addresses[sender.clientAddr]
+			}
+			if node != "" {
+				present[node] = true
+			} else if sender.state == "streaming" {
+				// e.g. pg_basebackup's backup or a standby catching up isn't added yet
+				found[host] = true
+			}
+		}
+	}
+	for host := range found {
+		added = append(added, host)
+	}
+	sort.Strings(added)
+	return added, present
+}
+
+// setDiscovery enables or disables the discovery mode, the discovered nodes are removed with the next setHosts
+// if it is disabled
+func (cluster *Cluster) setDiscovery(enabled bool, hostMapping map[string]string, expireAfter int) {
+	if !enabled {
+		cluster.discovery = nil
+	} else if cluster.discovery == nil {
+		cluster.discovery = NewDiscovery(hostMapping, expireAfter)
+	} else {
+		cluster.discovery.hostMapping = hostMapping
+		cluster.discovery.expireAfter = expireAfter
+	}
+}
+
+func (cluster *Cluster) isDiscovered(host string) bool {
+	if cluster.discovery == nil {
+		return false
+	}
+	_, discovered := cluster.discovery.discovered[host]
+	return discovered
+}
+
+// discoverNodes adds the new standbys, they are collected from the next collection on, and removes the discovered
+// ones missing from the masters' pg_stat_replication for too long together with their connections;
+// it returns the removed hosts
+func (cluster *Cluster) discoverNodes(state *ClusterState) (expired []string) {
+	if cluster.discovery == nil {
+		return nil
+	}
+	d := cluster.discovery
+	added, present := d.discover(state, cluster.nodes)
+	for _, host := range added {
+		cluster.nodes[host] = NewNode(cluster.dataSource, host)
+		d.discovered[host] = 0
+		present[host] = true
+		log.info("cluster %s standby %s discovered", cluster.name, host)
+	}
+	// without the masters' complete view a missing standby proves nothing
+	if len(state.masters) == 0 {
+		return nil
+	}
+	for _, master := range state.masters {
+		if !master.hasWalSenders {
+			return nil
+		}
+		present[master.host] = true
+	}
+	for host, missing := range d.discovered {
+		if present[host] {
+			d.discovered[host] = 0
+			continue
+		}
+		d.discovered[host] = missing + 1
+		if d.discovered[host] > d.expireAfter {
+			delete(d.discovered, host)
+			delete(cluster.nodes, host)
+			cluster.roleTracker.forget(host)
+			cluster.dataSource.remove(host)
+			expired = append(expired, host)
+			log.info("cluster %s standby %s expired, it has been missing from pg_stat_replication for %d collections", cluster.name, host, d.expireAfter)
+		}
+	}
+	sort.Strings(expired)
+	return expired
+}
+
+// parseHostMapping parses the `address=host` pairs of the --host-mapping options
+func parseHostMapping(pairs []string) (map[string]string, error) {
+	hostMapping := make(map[string]string)
+	for _, pair := range pairs {
+		address, host, found := strings.Cut(pair, "=")
+		if !found || address == "" {
+			return nil, fmt.Errorf("invalid host mapping `%s`, expected address=host", pair)
+		}
+		hostMapping[address] = host
+	}
+	return hostMapping, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDiscovery_discover(t *testing.T) {
+	d := NewDiscovery(map[string]string{"10.0.0.3": "node-3", "backup-host": ""}, 10)
+	d.lookupHost = func(host string) ([]string, error) {
+		if host == "node-7" {
+			return []string{"10.0.0.7"}, nil
+		}
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	master := &NodeState{host: "node-1", walSenders: []*WalSenderState{
+		// known by application_name
+		{applicationName: "node-2", clientAddr: "10.0.0.2", state: "streaming"},
+		// mapped client_addr
+		{applicationName: "walreceiver", clientAddr: "10.0.0.3", state: "streaming"},
+		// unmapped client_addr
+		{applicationName: "walreceiver", clientAddr: "10.0.0.4", state: "streaming"},
+		// ignored by the mapping
+		{applicationName: "backup-host", clientAddr: "10.0.0.5", state: "streaming"},
+		// not streaming yet
+		{applicationName: "walreceiver", clientAddr: "10.0.0.6", state: "catchup"},
+		// unix socket
+		{applicationName: "walreceiver", state: "streaming"},
+		// the default application_name, configured by its name
+		{applicationName: "walreceiver", clientAddr: "10.0.0.7", state: "streaming"},
+	}}
+	state := &ClusterState{masters: []*NodeState{master}}
+	nodes := map[string]*Node{"node-1": {host: "node-1"}, "node-2": {host: "node-2"}, "node-7": {host: "node-7"}}
+	added, present := d.discover(state, nodes)
+	assert.Equal(t, []string{"10.0.0.4", "node-3"}, added)
+	assert.Equal(t, map[string]bool{"node-2": true, "node-7": true}, present)
+
+	nodes["node-3"] = &Node{host: "node-3"}
+	nodes["10.0.0.4"] = &Node{host: "10.0.0.4"}
+	nodes["10.0.0.6"] = &Node{host: "10.0.0.6"}
+	added, present = d.discover(state, nodes)
+	assert.Empty(t, added)
+	assert.Equal(t, map[string]bool{"node-2": true, "node-3": true, "10.0.0.4": true, "10.0.0.6": true, "node-7": true}, present)
+}
+
+func TestDiscovery_parseHostMapping(t *testing.T) {
+	hostMapping, err := parseHostMapping([]string{"10.0.0.3=node-3", "backup-host="})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"10.0.0.3": "node-3", "backup-host": ""}, hostMapping)
+
+	_, err = parseHostMapping([]string{"node-3"})
+	assert.Error(t, err)
+	_, err = parseHostMapping([]string{"=node-3"})
+	assert.Error(t, err)
+}
+
+func TestCluster_setHostsKeepsDiscovered(t *testing.T) {
+	cluster := NewCluster(nil, "test", []string{"node-1", "node-2"}, 0, 0)
+	cluster.setDiscovery(true, nil, 10)
+	cluster.discoverNodes(&ClusterState{masters: []*NodeState{{host: "node-1", hasWalSenders: true, walSenders: []*WalSenderState{{clientAddr: "10.0.0.3", state: "streaming"}}}}})
+	assert.Contains(t, cluster.nodes, "10.0.0.3")
+
+	_, removed := cluster.setHosts([]string{"node-1"})
+	assert.Equal(t, []string{"node-2"}, removed)
+	assert.Contains(t, cluster.nodes, "10.0.0.3")
+
+	cluster.setDiscovery(false, nil, 10)
+	_, removed = cluster.setHosts([]string{"node-1"})
+	assert.Equal(t, []string{"10.0.0.3"}, removed)
+}
+
+func TestCluster_discoverNodesExpires(t *testing.T) {
+	measurer := NewMeasurer(NewMetrics(prometheus.NewRegistry(), nil), "test", nil)
+	config := &ClusterConfig{Port: "1", DBName: "postgres", SSLMode: "disable", User: "monitor", Password: "secret", MaxOpenConns: 1,
+		Nodes: []*NodeConfig{{Host: "node-1", Port: "1", DBName: "postgres", SSLMode: "disable"}}}
+	cluster := NewCluster(NewDataSource(measurer, config), "test", config.hosts(), 0, 0)
+	defer cluster.dataSource.close()
+	cluster.setDiscovery(true, nil, 2)
+	streaming := &ClusterState{masters: []*NodeState{{host: "node-1", hasWalSenders: true, walSenders: []*WalSenderState{{clientAddr: "10.0.0.3", state: "streaming"}}}}}
+	gone := &ClusterState{masters: []*NodeState{{host: "node-1", hasWalSenders: true}}}
+
+	assert.Empty(t, cluster.discoverNodes(streaming))
+	assert.Contains(t, cluster.nodes, "10.0.0.3")
+	assert.Empty(t, cluster.discoverNodes(gone))
+	// a standby back in pg_stat_replication starts counting from the beginning
+	assert.Empty(t, cluster.discoverNodes(streaming))
+	assert.Empty(t, cluster.discoverNodes(gone))
+	assert.Empty(t, cluster.discoverNodes(gone))
+	// nothing is known without the master or its wal senders
+	assert.Empty(t, cluster.discoverNodes(&ClusterState{}))
+	assert.Empty(t, cluster.discoverNodes(&ClusterState{masters: []*NodeState{{host: "node-1"}}}))
+	// sql.Open doesn't connect yet
+	_, err := cluster.dataSource.connect("10.0.0.3", false)
+	assert.NoError(t, err)
+	cluster.dataSource.retired["10.0.0.3"] = sql.DBStats{WaitCount: 2}
+	measurer.updatePoolStats(cluster.dataSource.stats())
+	assert.Equal(t, 1, testutil.CollectAndCount(measurer.poolWaitCount))
+
+	expired := cluster.discoverNodes(gone)
+	assert.Equal(t, []string{"10.0.0.3"}, expired)
+	assert.NotContains(t, cluster.nodes, "10.0.0.3")
+	assert.False(t, cluster.isDiscovered("10.0.0.3"))
+	// the expired host's pool is closed, its series don't come back with the next collections
+	assert.NotContains(t, cluster.dataSource.connection, "10.0.0.3")
+	assert.NotContains(t, cluster.dataSource.retired, "10.0.0.3")
+	updateClusterMetrics(cluster, measurer, &ClusterState{expired: expired})
+	updateClusterMetrics(cluster, measurer, &ClusterState{})
+	assert.Equal(t, 0, testutil.CollectAndCount(measurer.poolWaitCount))
+	assert.Equal(t, 0, testutil.CollectAndCount(measurer.poolOpenConnections))
+	// the configured nodes never expire
+	assert.Contains(t, cluster.nodes, "node-1")
+}
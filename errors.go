@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	errorCategoryConnect = "connect"
+	errorCategoryAuth    = "auth"
+	errorCategoryTimeout = "timeout"
+	errorCategoryQuery   = "query"
+	errorCategoryParse   = "parse"
+)
+
+// ParseError is returned when a query result can't be parsed: an unexpected columns count or a malformed field
+type ParseError struct {
+	what string
+	err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("failed to parse %s: %v", e.what, e.err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.err
+}
+
+// categorizeError maps errors produced by DataSource (database/sql, lib/pq, net) and the parsers to a small set of
+// categories used as a metric label
+func categorizeError(err error) string {
+	var parseErr *ParseError
+	var lsnErr *PgLsnParseError
+	var numErr *strconv.NumError
+	if errors.As(err, &parseErr) || errors.As(err, &lsnErr) || errors.As(err, &numErr) {
+		return errorCategoryParse
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errorCategoryTimeout
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code.Class() == "28": // invalid_authorization_specification, invalid_password
+			return errorCategoryAuth
+		case pqErr.Code == "57014": // query_canceled, e.g. statement_timeout
+			return errorCategoryTimeout
+		case pqErr.Code.Class() == "08", pqErr.Code == "57P03", pqErr.Code == "3D000": // connection_exception, cannot_connect_now, invalid_catalog_name
+			return errorCategoryConnect
+		default:
+			return errorCategoryQuery
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return errorCategoryTimeout
+		}
+		return errorCategoryConnect
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errorCategoryConnect
+	}
+	// lib/pq reports some of the connection errors as plain strings
+	if strings.Contains(err.Error(), "connection refused") || strings.Contains(err.Error(), "no such host") {
+		return errorCategoryConnect
+	}
+	return errorCategoryQuery
+}
+
+// isStatementError tells if the server has rejected the statement itself (syntax_error_or_access_rule_violation,
+// e.g. undefined_table or insufficient_privilege), the connection is fine then
+func isStatementError(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code.Class() == "42"
+}
+
+// isUndefinedTable tells if the queried table doesn't exist
+func isUndefinedTable(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "42P01"
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestErrors_categorizeError(t *testing.T) {
+	_, lsnErr := parsePgLsn("0-0")
+	assert.Equal(t, errorCategoryParse, categorizeError(fmt.Errorf("failed to parse: %w", lsnErr)))
+
+	// structural errors of the query results
+	_, parseErr := parseServerVersion([]string{"160002"})
+	assert.Equal(t, errorCategoryParse, categorizeError(&ParseError{what: "server version", err: parseErr}))
+	state := &NodeState{}
+	stateErr := parseState([]string{"false", "0/3000000", "0/0", "0/0", "", "1.0", "", "0003"}, state, time.Now())
+	assert.Equal(t, errorCategoryParse, categorizeError(fmt.Errorf("failed: %w", &ParseError{what: "node state", err: stateErr})))
+	assert.Equal(t, "failed to parse node state: unexpected wal file name `0003`", (&ParseError{what: "node state", err: stateErr}).Error())
+
+	authErr := &pq.Error{Code: "28P01", Message: "password authentication failed for user"}
+	assert.Equal(t, errorCategoryAuth, categorizeError(fmt.Errorf("failed to query recovery mode: %w", authErr)))
+
+	assert.Equal(t, errorCategoryTimeout, categorizeError(&pq.Error{Code: "57014"}))
+	assert.Equal(t, errorCategoryTimeout, categorizeError(fmt.Errorf("failed: %w", context.DeadlineExceeded)))
+
+	connErr := &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}
+	assert.Equal(t, errorCategoryConnect, categorizeError(fmt.Errorf("failed: %w", connErr)))
+
+	assert.Equal(t, errorCategoryQuery, categorizeError(&pq.Error{Code: "42883", Message: "function pg_current_wal_lsn() does not exist"}))
+}
+
+func TestErrors_statementErrors(t *testing.T) {
+	undefinedTable := fmt.Errorf("failed: %w", &pq.Error{Code: "42P01", Message: `relation "heartbeat" does not exist`})
+	assert.True(t, isStatementError(undefinedTable))
+	assert.True(t, isUndefinedTable(undefinedTable))
+	assert.True(t, isStatementError(&pq.Error{Code: "42501", Message: "permission denied for table heartbeat"}))
+	assert.False(t, isUndefinedTable(&pq.Error{Code: "42501"}))
+	connErr := &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}
+	assert.False(t, isStatementError(connErr))
+	assert.False(t, isUndefinedTable(nil))
+
+	// a rejected statement would fail on a new connection as well
+	ctx := context.Background()
+	assert.False(t, shouldReconnect(ctx, undefinedTable))
+	assert.True(t, shouldReconnect(ctx, connErr))
+	assert.False(t, shouldReconnect(ctx, nil))
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.False(t, shouldReconnect(cancelled, connErr))
+}
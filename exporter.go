@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/madflojo/tasks"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Exporter runs the clusters' collecting tasks and applies the configuration changes on reload
+type Exporter struct {
+	options   *Options
+	scheduler *tasks.Scheduler
+	metrics   *Metrics
+	// serializes reloads
+	mutex   sync.Mutex
+	config  *Config
+	runners map[string]*ClusterRunner
+}
+
+// ClusterRunner owns everything needed to collect a single cluster
+type ClusterRunner struct {
+	// serializes the collection and the configuration changes
+	mutex           sync.Mutex
+	config          *ClusterConfig
+	measurer        *Measurer
+	dataSource      *DataSource
+	cluster         *Cluster
+	taskId          string
+	heartbeatTaskId string
+	// the cluster has been removed, an on scrape collection in progress mustn't reopen the connections
+	stopped bool
+}
+
+func NewExporter(options *Options, scheduler *tasks.Scheduler, metrics *Metrics) *Exporter {
+	return &Exporter{
+		options:   options,
+		scheduler: scheduler,
+		metrics:   metrics,
+		runners:   make(map[string]*ClusterRunner),
+	}
+}
+
+func (e *Exporter) start(config *Config) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.config = config
+	for _, clusterConfig := range config.Clusters {
+		if err := e.startCluster(clusterConfig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Exporter) startCluster(config *ClusterConfig) error {
+	return e.startRunner(e.newClusterRunner(config))
+}
+
+// newClusterRunner builds the cluster's collecting objects, nothing is connected nor scheduled yet
+func (e *Exporter) newClusterRunner(config *ClusterConfig) *ClusterRunner {
+	// manual injections framework ;)
+	metrics := e.metrics
+	if e.options.OnScrape {
+		// the measurer collects its own metrics, they mustn't be exported by the default registry
+		metrics = NewMetrics(prometheus.NewRegistry(), e.metrics.extraLabelNames)
+	}
+	var measurer = NewMeasurer(metrics, config.Name, config.Labels)
+	var dataSource = NewDataSource(measurer, config)
+	var cluster = NewCluster(dataSource, config.Name, config.hosts(), time.Duration(config.NodeTimeout)*time.Second, config.LsnHistorySize)
+	cluster.setDiscovery(config.Discovery, config.HostMapping, config.DiscoveryExpiry)
+	return &ClusterRunner{config: config, measurer: measurer, dataSource: dataSource, cluster: cluster}
+}
+
+// startRunner registers the runner and schedules its tasks, a runner whose tasks failed is registered as well,
+// so the next reload reconfigures or stops it
+func (e *Exporter) startRunner(r *ClusterRunner) error {
+	config := r.config
+	e.runners[config.Name] = r
+	if err := r.scheduleHeartbeat(e.scheduler); err != nil {
+		return err
+	}
+	if e.options.OnScrape {
+		r.measurer.refresh = r.collectOnScrape
+		r.measurer.minRefresh = time.Duration(e.options.MinRefresh) * time.Second
+		log.info("Scraping cluster %s on scrape, at most every %d seconds", config.Name, e.options.MinRefresh)
+		return nil
+	}
+	if err := r.schedule(e.scheduler); err != nil {
+		return err
+	}
+	log.info("Scraping cluster %s every %d seconds", config.Name, config.Interval)
+	return nil
+}
+
+func (e *Exporter) stopCluster(name string) {
+	r := e.runners[name]
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.unschedule(e.scheduler)
+	r.dataSource.close()
+	r.stopped = true
+	r.measurer.deleteCluster(name)
+	delete(e.runners, name)
+	log.info("Stopped scraping cluster %s", name)
+}
+
+// reload re-reads the options' config and applies the differences: clusters and nodes are added or removed,
+// connections and tasks are recreated only if their settings have changed
+func (e *Exporter) reload() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	err := e.applyConfig()
+	e.metrics.updateReload(err == nil)
+	return err
+}
+
+// applyConfig validates the whole config and builds the new clusters' runners before changing anything,
+// so an invalid config leaves the running ones untouched; a scheduling error doesn't stop the other clusters'
+// changes, the config is applied as a whole and the errors are returned together
+func (e *Exporter) applyConfig() error {
+	config, err := e.options.loadConfig()
+	if err != nil {
+		return err
+	}
+	// label names are fixed when the metrics are registered
+	if !reflect.DeepEqual(config.labelNames(), e.metrics.extraLabelNames) {
+		return fmt.Errorf("clusters' label names %v differ from %v, restart required", config.labelNames(), e.metrics.extraLabelNames)
+	}
+	wanted := make(map[string]*ClusterConfig)
+	added := make(map[string]*ClusterRunner)
+	for _, clusterConfig := range config.Clusters {
+		wanted[clusterConfig.Name] = clusterConfig
+		if e.runners[clusterConfig.Name] == nil {
+			added[clusterConfig.Name] = e.newClusterRunner(clusterConfig)
+		}
+	}
+	for name := range e.runners {
+		if wanted[name] == nil {
+			e.stopCluster(name)
+		}
+	}
+	var errs []error
+	for _, clusterConfig := range config.Clusters {
+		if r := added[clusterConfig.Name]; r != nil {
+			errs = append(errs, e.startRunner(r))
+		} else {
+			errs = append(errs, e.runners[clusterConfig.Name].reconfigure(e.scheduler, clusterConfig))
+		}
+	}
+	e.config = config
+	if err = errors.Join(errs...); err != nil {
+		return err
+	}
+	log.info("Configuration reloaded, scraping %d cluster(s)", len(e.runners))
+	return nil
+}
+
+// ServeReload handles POST /-/reload
+func (e *Exporter) ServeReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := e.reload(); err != nil {
+		log.error("reloading configuration error: %v", err)
+		http.Error(w, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (r *ClusterRunner) schedule(scheduler *tasks.Scheduler) error {
+	var err error
+	r.taskId, err = scheduler.Add(&tasks.Task{
+		Interval: time.Duration(r.config.Interval) * time.Second,
+		TaskFunc: func() error {
+			r.collect()
+			return nil
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to schedule cluster %s task: %w", r.config.Name, err)
+	}
+	return nil
+}
+
+func (r *ClusterRunner) scheduleHeartbeat(scheduler *tasks.Scheduler) error {
+	if r.config.HeartbeatTable == "" {
+		r.cluster.heartbeat = nil
+		return nil
+	}
+	// the writer has its own connections, it runs concurrently with the collecting task
+	heartbeat := NewHeartbeat(NewDataSource(r.measurer, r.config), r.config.HeartbeatTable)
+	if r.cluster.heartbeat != nil {
+		heartbeat.followMaster(r.cluster.heartbeat.master())
+	}
+	timeout := time.Duration(r.config.NodeTimeout) * time.Second
+	clusterName := r.config.Name
+	var err error
+	r.heartbeatTaskId, err = scheduler.Add(&tasks.Task{
+		Interval: time.Duration(r.config.HeartbeatInterval) * time.Second,
+		TaskFunc: func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if heartbeatErr := heartbeat.write(ctx); heartbeatErr != nil {
+				log.error("writing cluster %s heartbeat error: %v", clusterName, heartbeatErr)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to schedule cluster %s heartbeat task: %w", clusterName, err)
+	}
+	r.cluster.heartbeat = heartbeat
+	return nil
+}
+
+func (r *ClusterRunner) unscheduleHeartbeat(scheduler *tasks.Scheduler) {
+	if r.heartbeatTaskId != "" {
+		scheduler.Del(r.heartbeatTaskId)
+		r.heartbeatTaskId = ""
+	}
+	if r.cluster.heartbeat != nil {
+		r.cluster.heartbeat.stop()
+	}
+}
+
+func (r *ClusterRunner) unschedule(scheduler *tasks.Scheduler) {
+	if r.taskId != "" {
+		scheduler.Del(r.taskId)
+		r.taskId = ""
+	}
+	r.unscheduleHeartbeat(scheduler)
+}
+
+func (r *ClusterRunner) collect() {
+	if !r.mutex.TryLock() {
+		log.warn("cluster %s previous collection is still running, skipping", r.config.Name)
+		return
+	}
+	defer r.mutex.Unlock()
+	r.measurer.updateRuntimeInfo(ProgramFullName, ProgramVersion)
+	collectClusterMetrics(r.cluster, r.measurer)
+}
+
+// collectOnScrape waits for a collection or a configuration change in progress
+func (r *ClusterRunner) collectOnScrape() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stopped {
+		return
+	}
+	r.measurer.updateRuntimeInfo(ProgramFullName, ProgramVersion)
+	collectClusterMetrics(r.cluster, r.measurer)
+}
+
+func (r *ClusterRunner) reconfigure(scheduler *tasks.Scheduler, config *ClusterConfig) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	previous := r.config
+	if reflect.DeepEqual(previous, config) {
+		return nil
+	}
+	r.config = config
+	r.cluster.setDiscovery(config.Discovery, config.HostMapping, config.DiscoveryExpiry)
+	added, removed := r.cluster.setHosts(config.hosts())
+	// the discovered nodes keep their connections
+	r.dataSource.configure(config, r.cluster.hosts())
+	for _, host := range removed {
+		r.measurer.deleteHost(config.Name, host)
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		log.info("cluster %s nodes added: %v, removed: %v", config.Name, added, removed)
+	}
+	r.cluster.nodeTimeout = time.Duration(config.NodeTimeout) * time.Second
+	if previous.LsnHistorySize != config.LsnHistorySize {
+		r.cluster.setLsnHistorySize(config.LsnHistorySize)
+	}
+	// heartbeat settings or connection settings could have changed, the writer is stopped before the labels change
+	r.unscheduleHeartbeat(scheduler)
+	if !reflect.DeepEqual(previous.Labels, config.Labels) {
+		// series with the old label values would never be refreshed
+		r.measurer.setClusterLabels(config.Labels)
+		r.measurer.series = NewSeriesTracker()
+	}
+	heartbeatErr := r.scheduleHeartbeat(scheduler)
+	if previous.Interval != config.Interval && r.taskId != "" {
+		scheduler.Del(r.taskId)
+		if err := r.schedule(scheduler); err != nil {
+			return errors.Join(heartbeatErr, err)
+		}
+		log.info("cluster %s interval changed to %d seconds", config.Name, config.Interval)
+	}
+	return heartbeatErr
+}
+
+func collectClusterMetrics(cluster *Cluster, measurer *Measurer) {
+	state, collectErr := cluster.queryForState()
+	if collectErr != nil {
+		log.error("collecting cluster %s data error: %v", cluster.name, collectErr)
+	}
+	updateClusterMetrics(cluster, measurer, state)
+}
+
+// updateClusterMetrics exports the collected state, in a split-brain every standby's lag is calculated against
+// each pretending master and the negative lags aren't counted as anomalies
+func updateClusterMetrics(cluster *Cluster, measurer *Measurer, state *ClusterState) {
+	measurer.beginCollection()
+	defer measurer.endCollection()
+	measurer.updateClusterState(state)
+	measurer.updatePoolStats(cluster.dataSource.stats())
+	for _, masterState := range state.masters {
+		log.debug("master %s current wal LSN %d (%s)", masterState.host, masterState.currentWalLsnBytes, masterState.currentWalLsn)
+		measurer.updateWalSenders(masterState)
+		measurer.updateSyncQuorum(masterState)
+		measurer.updateReplicationSlots(masterState)
+		for _, slaveState := range state.slaves {
+			slaveLag := cluster.calculateSlaveLag(*masterState, *slaveState)
+			if state.isSplitBrain() {
+				// the other master's standbys may be ahead of this one, it isn't an anomaly
+				slaveLag.negative = false
+			}
+			measurer.updateSlaveLag(masterState, slaveState, slaveLag)
+			log.debug("slave %s receive lag %d, replay lag %d (%f s)", slaveState.host, slaveLag.receiveLag, slaveLag.replayLag, slaveLag.replayLagSeconds)
+		}
+	}
+	// lags relative to the root master are above, a cascading standby's own contribution is its upstream lag
+	for _, slaveState := range state.slaves {
+		if upstreamState := state.upstreamOf(slaveState); upstreamState != nil {
+			measurer.updateUpstreamLag(upstreamState, slaveState, calculateUpstreamLag(*upstreamState, *slaveState))
+		}
+	}
+	for _, host := range state.expired {
+		measurer.deleteHost(cluster.name, host)
+	}
+}
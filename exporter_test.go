@@ -0,0 +1,221 @@
+package main
+
+import (
+	"github.com/madflojo/tasks"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+const exporterTestConfig = `
+clusters:
+  - name: orders
+    user: monitor
+    password: secret
+    labels:
+      env: dev
+    nodes:
+      - host: orders-1
+      - host: orders-2
+  - name: billing
+    user: monitor
+    password: secret
+    nodes:
+      - host: billing-1
+      - host: billing-2
+`
+
+// newTestExporter starts an exporter whose tasks never run during the test
+func newTestExporter(t *testing.T, content string) (*Exporter, string) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	options := &Options{Config: path, Port: "6432", Interval: 3600, NodeTimeout: 1, LsnHistory: 10, HeartbeatInterval: 1, MaxOpenConns: 2, MaxIdleConns: 1}
+	config, err := options.loadConfig()
+	assert.NoError(t, err)
+	scheduler := tasks.New()
+	t.Cleanup(scheduler.Stop)
+	exporter := NewExporter(options, scheduler, NewMetrics(prometheus.NewRegistry(), config.labelNames()))
+	assert.NoError(t, exporter.start(config))
+	return exporter, path
+}
+
+func (e *Exporter) runnerNames() []string {
+	names := make([]string, 0, len(e.runners))
+	for name := range e.runners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Cluster) hostNames() []string {
+	hosts := make([]string, 0, len(c.nodes))
+	for host := range c.nodes {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func TestExporter_reload(t *testing.T) {
+	exporter, path := newTestExporter(t, exporterTestConfig)
+	assert.Equal(t, []string{"billing", "orders"}, exporter.runnerNames())
+	orders, billing := exporter.runners["orders"], exporter.runners["billing"]
+	orders.measurer.set(orders.measurer.primaries, orders.measurer.labels(prometheus.Labels{}), 1)
+	orders.measurer.set(orders.measurer.nodeUp, orders.measurer.labels(prometheus.Labels{hostLabel: "orders-2"}), 1)
+	billing.measurer.set(billing.measurer.primaries, billing.measurer.labels(prometheus.Labels{}), 1)
+
+	// billing is removed, payments is added, orders gets a node and loses one, its label changes
+	assert.NoError(t, os.WriteFile(path, []byte(`
+clusters:
+  - name: orders
+    user: monitor
+    password: secret
+    labels:
+      env: prod
+    nodes:
+      - host: orders-1
+      - host: orders-3
+  - name: payments
+    user: monitor
+    password: secret
+    nodes:
+      - host: payments-1
+      - host: payments-2
+`), 0600))
+	assert.NoError(t, exporter.reload())
+	assert.Equal(t, []string{"orders", "payments"}, exporter.runnerNames())
+	assert.Same(t, orders, exporter.runners["orders"])
+	assert.True(t, billing.stopped)
+	assert.Equal(t, []string{"orders-1", "orders-3"}, orders.cluster.hostNames())
+	assert.Equal(t, map[string]string{"env": "prod"}, orders.measurer.clusterLabels)
+	assert.Equal(t, "payments", exporter.config.Clusters[1].Name)
+	assert.Equal(t, float64(1), testutil.ToFloat64(exporter.metrics.lastReloadSuccessful))
+	// the removed cluster's series and the series with the old label values are gone
+	assert.Equal(t, 0, testutil.CollectAndCount(exporter.metrics.primaries))
+	assert.Equal(t, 0, testutil.CollectAndCount(exporter.metrics.nodeUp))
+
+	// the label names can't change, nothing is applied
+	config := exporter.config
+	assert.NoError(t, os.WriteFile(path, []byte(exporterTestConfig+"    labels:\n      team: billing\n"), 0600))
+	assert.Error(t, exporter.reload())
+	assert.Equal(t, []string{"orders", "payments"}, exporter.runnerNames())
+	assert.Same(t, config, exporter.config)
+	assert.Equal(t, float64(0), testutil.ToFloat64(exporter.metrics.lastReloadSuccessful))
+
+	// an invalid config isn't applied either
+	assert.NoError(t, os.WriteFile(path, []byte("clusters:\n  - name: orders\n"), 0600))
+	assert.Error(t, exporter.reload())
+	assert.Equal(t, []string{"orders", "payments"}, exporter.runnerNames())
+	assert.Same(t, config, exporter.config)
+}
+
+func TestExporter_ServeReload(t *testing.T) {
+	exporter, path := newTestExporter(t, exporterTestConfig)
+
+	w := httptest.NewRecorder()
+	exporter.ServeReload(w, httptest.NewRequest(http.MethodGet, "/-/reload", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, http.MethodPost, w.Header().Get("Allow"))
+
+	w = httptest.NewRecorder()
+	exporter.ServeReload(w, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.NoError(t, os.WriteFile(path, []byte("clusters: ["), 0600))
+	w = httptest.NewRecorder()
+	exporter.ServeReload(w, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "failed to reload config")
+}
+
+func TestClusterRunner_reconfigure(t *testing.T) {
+	exporter, _ := newTestExporter(t, exporterTestConfig)
+	r := exporter.runners["orders"]
+	taskId := r.taskId
+
+	config := *r.config
+	config.Nodes = []*NodeConfig{{Host: "orders-2"}, {Host: "orders-3"}}
+	config.Interval = 1800
+	config.LsnHistorySize = 20
+	assert.NoError(t, r.reconfigure(exporter.scheduler, &config))
+	assert.Equal(t, []string{"orders-2", "orders-3"}, r.cluster.hostNames())
+	assert.NotEqual(t, taskId, r.taskId)
+	assert.Same(t, &config, r.config)
+
+	// nothing has changed, nothing is rescheduled
+	taskId = r.taskId
+	same := config
+	assert.NoError(t, r.reconfigure(exporter.scheduler, &same))
+	assert.Equal(t, taskId, r.taskId)
+}
+
+func TestExporter_stopCluster(t *testing.T) {
+	exporter, _ := newTestExporter(t, exporterTestConfig)
+	r := exporter.runners["billing"]
+	r.measurer.set(r.measurer.primaries, r.measurer.labels(prometheus.Labels{}), 1)
+	exporter.stopCluster("billing")
+	assert.Equal(t, []string{"orders"}, exporter.runnerNames())
+	assert.True(t, r.stopped)
+	assert.Empty(t, r.taskId)
+	assert.Equal(t, 0, testutil.CollectAndCount(exporter.metrics.primaries))
+	// an on scrape collection after the stop doesn't collect
+	r.collectOnScrape()
+	assert.Empty(t, r.dataSource.stats())
+}
+
+func TestUpdateClusterMetrics_splitBrain(t *testing.T) {
+	measurer := NewMeasurer(NewMetrics(prometheus.NewRegistry(), nil), "test", nil)
+	config := &ClusterConfig{Name: "test", MaxOpenConns: 1}
+	cluster := NewCluster(NewDataSource(measurer, config), "test", []string{"node-1", "node-2", "node-3"}, 0, 10)
+	cluster.heartbeat = NewHeartbeat(nil, "heartbeat")
+	cluster.heartbeat.followMaster("node-1")
+	cluster.updateLsnHistory(&NodeState{host: "node-1", currentWalLsnBytes: 100}, time.Now())
+
+	master1 := &NodeState{host: "node-1", currentWalLsnBytes: 1000}
+	master2 := &NodeState{host: "node-2", currentWalLsnBytes: 2000}
+	slave := &NodeState{host: "node-3", isInRecovery: true, lastWalReceiveLsnBytes: 900, lastWalReplayLsnBytes: 800}
+	// streams from node-2, it is ahead of node-1
+	ahead := &NodeState{host: "node-4", isInRecovery: true, lastWalReceiveLsnBytes: 1500, lastWalReplayLsnBytes: 1500}
+	state := &ClusterState{masters: []*NodeState{master1, master2}, slaves: map[string]*NodeState{"node-3": slave, "node-4": ahead}}
+	assert.True(t, state.isSplitBrain())
+	assert.Equal(t, []string{"node-1", "node-2"}, state.masterHosts())
+
+	// the history and the heartbeat stay with the last known master
+	assert.NoError(t, cluster.followMaster(state))
+	assert.Equal(t, "node-1", cluster.lsnHistoryHost)
+	assert.Equal(t, "node-1", cluster.heartbeat.master())
+
+	updateClusterMetrics(cluster, measurer, state)
+	assert.Equal(t, float64(2), testutil.ToFloat64(measurer.primaries))
+	assert.Equal(t, float64(1), testutil.ToFloat64(measurer.splitBrain.With(measurer.labels(prometheus.Labels{hostsLabel: "node-1,node-2"}))))
+	// the standby's lag is calculated against each pretending master
+	lagOf := func(masterHost string) float64 {
+		return testutil.ToFloat64(measurer.receiveLagBytes.With(measurer.labels(prometheus.Labels{hostLabel: "node-3", masterHostLabel: masterHost, inRecoveryLabel: "true"})))
+	}
+	assert.Equal(t, float64(100), lagOf("node-1"))
+	assert.Equal(t, float64(1100), lagOf("node-2"))
+	assert.Equal(t, 4, testutil.CollectAndCount(measurer.receiveLagBytes))
+	// a standby of the other master isn't an anomaly, however long the split-brain lasts
+	updateClusterMetrics(cluster, measurer, state)
+	assert.Equal(t, 0, testutil.CollectAndCount(measurer.negativeLagAnomaliesTotal))
+
+	// the split-brain is over, node-2 is the master now
+	state = &ClusterState{masters: []*NodeState{master2}, slaves: map[string]*NodeState{"node-3": slave}}
+	assert.NoError(t, cluster.followMaster(state))
+	assert.Equal(t, "node-2", cluster.lsnHistoryHost)
+	assert.Equal(t, "node-2", cluster.heartbeat.master())
+	updateClusterMetrics(cluster, measurer, state)
+	assert.Equal(t, float64(1), testutil.ToFloat64(measurer.primaries))
+	assert.Equal(t, float64(0), testutil.ToFloat64(measurer.splitBrain.With(measurer.labels(prometheus.Labels{hostsLabel: "node-2"}))))
+	// the series of the former pretender and the old hosts label are gone
+	assert.Equal(t, 1, testutil.CollectAndCount(measurer.receiveLagBytes))
+	assert.Equal(t, 1, testutil.CollectAndCount(measurer.splitBrain))
+}
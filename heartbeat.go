@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lib/pq"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Heartbeat writes the current timestamp to a table on the master, standbys read it back to measure the end-to-end lag
+// (like pt-heartbeat does). The writer has its own data source because it runs in its own scheduler task.
+type Heartbeat struct {
+	table      string
+	dataSource *DataSource
+	// guards the fields below, it isn't held during the writes, so the collection following the master doesn't wait
+	mutex      sync.Mutex
+	masterHost string
+	// the master where the table has been created
+	tableHost string
+	// cancels the write in progress, see stop
+	cancelWrite context.CancelFunc
+	stopped     bool
+	// serializes the writes, stop waits for the one in progress
+	writeMutex sync.Mutex
+}
+
+func NewHeartbeat(dataSource *DataSource, table string) *Heartbeat {
+	return &Heartbeat{table: quoteQualifiedIdentifier(table), dataSource: dataSource}
+}
+
+// quoteQualifiedIdentifier quotes each part of a (possibly schema qualified) name
+func quoteQualifiedIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// followMaster points the writer to the master detected by the last cluster state query
+func (h *Heartbeat) followMaster(host string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.masterHost != host {
+		log.info("heartbeat master changed from `%s` to `%s`", h.masterHost, host)
+		h.masterHost = host
+	}
+}
+
+func (h *Heartbeat) master() string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.masterHost
+}
+
+func (h *Heartbeat) setTableHost(host string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.tableHost = host
+}
+
+func (h *Heartbeat) write(ctx context.Context) error {
+	h.writeMutex.Lock()
+	defer h.writeMutex.Unlock()
+	h.mutex.Lock()
+	if h.stopped {
+		h.mutex.Unlock()
+		return nil
+	}
+	masterHost, tableHost := h.masterHost, h.tableHost
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	h.cancelWrite = cancel
+	h.mutex.Unlock()
+	if masterHost == "" {
+		log.debug("heartbeat master is unknown yet, skipping")
+		return nil
+	}
+	if tableHost != masterHost {
+		q := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY, ts TIMESTAMPTZ NOT NULL)", h.table)
+		if err := h.dataSource.ExecWithEffort(ctx, masterHost, q); err != nil {
+			return fmt.Errorf("failed to create heartbeat table on %s: %w", masterHost, err)
+		}
+		h.setTableHost(masterHost)
+	}
+	q := fmt.Sprintf("INSERT INTO %s (id, ts) VALUES (1, clock_timestamp()) ON CONFLICT (id) DO UPDATE SET ts = EXCLUDED.ts", h.table)
+	if err := h.dataSource.ExecWithEffort(ctx, masterHost, q); err != nil {
+		// the table could have been dropped, create it again next time
+		h.setTableHost("")
+		return fmt.Errorf("failed to write heartbeat on %s: %w", masterHost, err)
+	}
+	return nil
+}
+
+// stop cancels the write in progress, waits for it and closes the connections, the writer doesn't write anymore;
+// the scheduler doesn't wait for a task it has removed
+func (h *Heartbeat) stop() {
+	h.mutex.Lock()
+	h.stopped = true
+	if h.cancelWrite != nil {
+		h.cancelWrite()
+	}
+	h.mutex.Unlock()
+	h.writeMutex.Lock()
+	defer h.writeMutex.Unlock()
+	h.dataSource.close()
+}
+
+// queryHeartbeatAge returns seconds elapsed since the heartbeat visible on the node has been written on the master,
+// the value is unknown if the heartbeat table or row doesn't exist (yet)
+func (n *Node) queryHeartbeatAge(ctx context.Context, table string) (float64, bool, error) {
+	var ageStr string
+	var err error
+	q := fmt.Sprintf("SELECT COALESCE((SELECT EXTRACT(EPOCH FROM now() - ts) FROM %s WHERE id = 1)::TEXT,'')", table)
+	if ageStr, err = n.db.QueryStrWithEffort(ctx, n.host, q); isUndefinedTable(err) {
+		// the writer hasn't created the table yet or its creation hasn't been replicated yet
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, fmt.Errorf("failed to query heartbeat: %w", err)
+	}
+	if ageStr == "" {
+		return 0, false, nil
+	}
+	var age float64
+	if age, err = strconv.ParseFloat(ageStr, 64); err != nil {
+		return 0, false, &ParseError{what: "heartbeat age", err: err}
+	}
+	return age, true, nil
+}
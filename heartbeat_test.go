@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat_quoteQualifiedIdentifier(t *testing.T) {
+	assert.Equal(t, `"heartbeat"`, quoteQualifiedIdentifier("heartbeat"))
+	assert.Equal(t, `"monitoring"."heartbeat"`, quoteQualifiedIdentifier("monitoring.heartbeat"))
+	assert.Equal(t, `"mon""itoring"."Heart beat"`, quoteQualifiedIdentifier(`mon"itoring.Heart beat`))
+}
+
+func TestHeartbeat_followMaster(t *testing.T) {
+	heartbeat := NewHeartbeat(nil, "monitoring.heartbeat")
+	assert.Equal(t, `"monitoring"."heartbeat"`, heartbeat.table)
+	assert.Empty(t, heartbeat.master())
+	heartbeat.followMaster("node-1")
+	assert.Equal(t, "node-1", heartbeat.master())
+	heartbeat.followMaster("node-2")
+	assert.Equal(t, "node-2", heartbeat.master())
+}
+
+func TestHeartbeat_write(t *testing.T) {
+	measurer := NewMeasurer(NewMetrics(prometheus.NewRegistry(), nil), "test", nil)
+	dataSource := NewDataSource(measurer, &ClusterConfig{Port: "1", DBName: "postgres", SSLMode: "disable", User: "monitor", Password: "secret", MaxOpenConns: 1})
+	defer dataSource.close()
+	heartbeat := NewHeartbeat(dataSource, "heartbeat")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the master is unknown yet, nothing is written
+	assert.NoError(t, heartbeat.write(ctx))
+	assert.Equal(t, 0, testutil.CollectAndCount(measurer.queriesCountTotal))
+
+	// nobody listens on the port, the table isn't created, so it is created with the next write
+	heartbeat.followMaster("127.0.0.1")
+	err := heartbeat.write(ctx)
+	assert.ErrorContains(t, err, "failed to create heartbeat table on 127.0.0.1")
+	assert.Empty(t, heartbeat.tableHost)
+	assert.Equal(t, float64(1), testutil.ToFloat64(measurer.reconnectsCountTotal.With(measurer.labels(prometheus.Labels{hostLabel: "127.0.0.1"}))))
+}
+
+func TestHeartbeat_stop(t *testing.T) {
+	fakeNodes.Store("heartbeat-1", &fakeNode{})
+	fakeNodes.Store("heartbeat-2", &fakeNode{hung: true})
+	measurer := NewMeasurer(NewMetrics(prometheus.NewRegistry(), nil), "test", nil)
+	dataSource := NewDataSource(measurer, &ClusterConfig{User: "monitor", Password: "secret", MaxOpenConns: 1})
+	dataSource.driverName = "fake"
+	heartbeat := NewHeartbeat(dataSource, "heartbeat")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	heartbeat.followMaster("heartbeat-1")
+	assert.NoError(t, heartbeat.write(ctx))
+	assert.Equal(t, "heartbeat-1", heartbeat.tableHost)
+
+	// the master hangs, following the master doesn't wait for the write
+	heartbeat.followMaster("heartbeat-2")
+	written := make(chan error)
+	go func() {
+		written <- heartbeat.write(ctx)
+	}()
+	assert.Eventually(t, func() bool { return dataSource.stats()["heartbeat-2"].InUse == 1 }, 5*time.Second, 10*time.Millisecond)
+	heartbeat.followMaster("heartbeat-1")
+	assert.Equal(t, "heartbeat-1", heartbeat.master())
+
+	// the write in progress is cancelled and awaited, nothing reopens the connections
+	heartbeat.stop()
+	assert.ErrorIs(t, <-written, context.Canceled)
+	assert.NoError(t, heartbeat.write(ctx))
+	assert.Empty(t, dataSource.stats())
+}
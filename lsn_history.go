@@ -0,0 +1,79 @@
+package main
+
+import (
+	"time"
+)
+
+type LsnSample struct {
+	timestamp time.Time
+	lsnBytes  uint64
+}
+
+// LsnHistory is a ring buffer of the master's current wal locations, it lets us estimate when the master was
+// at the location a standby has reached
+type LsnHistory struct {
+	samples []LsnSample
+	first   int
+	count   int
+}
+
+func NewLsnHistory(size int) *LsnHistory {
+	if size < 2 {
+		size = 2
+	}
+	return &LsnHistory{samples: make([]LsnSample, size)}
+}
+
+// at returns i-th sample counting from the oldest one
+func (h *LsnHistory) at(i int) LsnSample {
+	return h.samples[(h.first+i)%len(h.samples)]
+}
+
+func (h *LsnHistory) reset() {
+	h.first = 0
+	h.count = 0
+}
+
+func (h *LsnHistory) add(timestamp time.Time, lsnBytes uint64) {
+	if h.count > 0 {
+		newest := h.at(h.count - 1)
+		if lsnBytes < newest.lsnBytes || !timestamp.After(newest.timestamp) {
+			// the master went back in time (e.g. a new one), older samples are useless
+			h.reset()
+		}
+	}
+	if h.count < len(h.samples) {
+		h.samples[(h.first+h.count)%len(h.samples)] = LsnSample{timestamp: timestamp, lsnBytes: lsnBytes}
+		h.count++
+	} else {
+		h.samples[h.first] = LsnSample{timestamp: timestamp, lsnBytes: lsnBytes}
+		h.first = (h.first + 1) % len(h.samples)
+	}
+}
+
+// estimateLag returns how many seconds ago (relative to the newest sample) the master passed the given location,
+// the lag is unknown if the location is older than the oldest sample
+func (h *LsnHistory) estimateLag(lsnBytes uint64) (float64, bool) {
+	if h.count == 0 {
+		return 0, false
+	}
+	newest := h.at(h.count - 1)
+	if lsnBytes >= newest.lsnBytes {
+		return 0, true
+	}
+	if lsnBytes < h.at(0).lsnBytes {
+		return 0, false
+	}
+	// find the first sample which has passed the location and interpolate between it and the previous one
+	for i := 1; i < h.count; i++ {
+		next := h.at(i)
+		if next.lsnBytes <= lsnBytes {
+			continue
+		}
+		prev := h.at(i - 1)
+		ratio := float64(lsnBytes-prev.lsnBytes) / float64(next.lsnBytes-prev.lsnBytes)
+		passedAt := prev.timestamp.Add(time.Duration(ratio * float64(next.timestamp.Sub(prev.timestamp))))
+		return newest.timestamp.Sub(passedAt).Seconds(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLsnHistory_estimateLag(t *testing.T) {
+	h := NewLsnHistory(3)
+	_, known := h.estimateLag(100)
+	assert.False(t, known)
+
+	t0 := time.Unix(1_600_000_000, 0)
+	h.add(t0, 1000)
+	h.add(t0.Add(10*time.Second), 2000)
+	h.add(t0.Add(20*time.Second), 2000) // idle master
+	h.add(t0.Add(30*time.Second), 4000) // the oldest sample is dropped
+
+	lag, known := h.estimateLag(4000)
+	assert.True(t, known)
+	assert.Equal(t, float64(0), lag)
+
+	// the master passed 2000 between the 20th and 30th second
+	lag, known = h.estimateLag(2000)
+	assert.True(t, known)
+	assert.Equal(t, float64(10), lag)
+
+	lag, known = h.estimateLag(3000)
+	assert.True(t, known)
+	assert.Equal(t, float64(5), lag)
+
+	// older than the oldest sample
+	_, known = h.estimateLag(1500)
+	assert.False(t, known)
+
+	// a new master with a lower location resets the history
+	h.add(t0.Add(40*time.Second), 3000)
+	_, known = h.estimateLag(2000)
+	assert.False(t, known)
+	lag, known = h.estimateLag(3000)
+	assert.True(t, known)
+	assert.Equal(t, float64(0), lag)
+}
@@ -6,13 +6,15 @@ import (
 	"fmt"
 	_ "github.com/lib/pq"
 	"github.com/madflojo/tasks"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/voxelbrain/goptions"
 	"net/http"
 	"os"
+	"os/signal"
 	"sort"
 	"strings"
-	"time"
+	"syscall"
 )
 
 const (
@@ -29,25 +31,95 @@ func clusterHash(nodes []string) string {
 	return "cluster-" + hex.EncodeToString(hash[:3])
 }
 
+type Options struct {
+	Address           string   `goptions:"-A, --address, description='Address to listens on the TCP network'"`
+	Path              string   `goptions:"-P, --path, description='Path under which to expose metrics'"`
+	Config            string   `goptions:"-c, --config, description='YAML configuration file with clusters, replaces the cluster options'"`
+	ClusterName       string   `goptions:"-C, --cluster-name, description='Cluster name'"`
+	Nodes             []string `goptions:"-n, --node, description='Replication cluster nodes. May be specified more than once'"`
+	Port              string   `goptions:"-p, --port, description='TCP port that Postgres listens on'"`
+	User              string   `goptions:"-u, --user, description='User to connect as'"`
+	Password          string   `goptions:"-s, --password, description='Password to connect with'"`
+	Interval          int64    `goptions:"-i, --interval, description='Collecting metrics interval in seconds'"`
+	NodeTimeout       int64    `goptions:"--node-timeout, description='Collecting a single node state timeout in seconds'"`
+	LsnHistory        int      `goptions:"--lsn-history-size, description='Number of the master wal location samples kept to estimate lag in seconds'"`
+	HeartbeatTable    string   `goptions:"--heartbeat-table, description='Table the heartbeat is written to on the master and read from on standbys, enables the heartbeat mode'"`
+	HeartbeatInterval int64    `goptions:"--heartbeat-interval, description='Writing heartbeat interval in seconds'"`
+	MaxOpenConns      int      `goptions:"--max-open-conns, description='Maximum number of open connections to a node'"`
+	MaxIdleConns      int      `goptions:"--max-idle-conns, description='Maximum number of idle connections to a node'"`
+	ConnMaxLifetime   int64    `goptions:"--conn-max-lifetime, description='Maximum seconds a connection may be reused, 0 means unlimited'"`
+	ConnMaxIdleTime   int64    `goptions:"--conn-max-idle-time, description='Maximum seconds a connection may be idle, 0 means unlimited'"`
+	OnScrape          bool     `goptions:"--on-scrape, description='Collect metrics at scrape time instead of every interval'"`
+	MinRefresh        int64    `goptions:"--min-refresh, description='Minimum seconds between on scrape collections, scrapes within it get the cached metrics'"`
+	Discovery         bool     `goptions:"--discovery, description='Add the standbys streaming from the master to the nodes, the nodes are the seeds'"`
+	DiscoveryExpiry   int      `goptions:"--discovery-expiry, description='Collections a discovered standby may be missing from the master pg_stat_replication before it is removed'"`
+	HostMappings      []string `goptions:"--host-mapping, description='Discovered standby client_addr or application_name mapped to the host to connect to (address=host, empty host ignores the standby). May be specified more than once'"`
+	Verbosity         int      `goptions:"-V, --verbosity, description='Verbosity level (0 errors, 1 +warnings, 2 +infos, 3 +debugs)'"`
+	Version           bool     `goptions:"-v, --version, description='Output version information, then exit'"`
+	Help              bool     `goptions:"-h, --help, description='Show this help, then exit'"`
+}
+
+// clusterDefaults returns the cluster options, the clusters from the config file inherit them
+func (o *Options) clusterDefaults() *ClusterConfig {
+	return &ClusterConfig{
+		Name:              o.ClusterName,
+		Port:              o.Port,
+		DBName:            "postgres",
+		SSLMode:           "disable",
+		User:              o.User,
+		Password:          o.Password,
+		Interval:          o.Interval,
+		NodeTimeout:       o.NodeTimeout,
+		LsnHistorySize:    o.LsnHistory,
+		HeartbeatTable:    o.HeartbeatTable,
+		HeartbeatInterval: o.HeartbeatInterval,
+		MaxOpenConns:      o.MaxOpenConns,
+		MaxIdleConns:      o.MaxIdleConns,
+		ConnMaxLifetime:   o.ConnMaxLifetime,
+		ConnMaxIdleTime:   o.ConnMaxIdleTime,
+		Discovery:         o.Discovery,
+		DiscoveryExpiry:   o.DiscoveryExpiry,
+	}
+}
+
+// loadConfig reads the config file or builds a single cluster config from the options
+func (o *Options) loadConfig() (*Config, error) {
+	if o.Config != "" {
+		if len(o.Nodes) > 0 {
+			return nil, fmt.Errorf("nodes can't be specified with the config file")
+		}
+		if len(o.HostMappings) > 0 {
+			return nil, fmt.Errorf("host mappings can't be specified with the config file, use host_mapping")
+		}
+		return loadConfig(o.Config, o.clusterDefaults())
+	}
+	cluster := o.clusterDefaults()
+	var err error
+	if cluster.HostMapping, err = parseHostMapping(o.HostMappings); err != nil {
+		return nil, err
+	}
+	for _, host := range o.Nodes {
+		cluster.Nodes = append(cluster.Nodes, &NodeConfig{Host: host})
+	}
+	config := &Config{Clusters: []*ClusterConfig{cluster}}
+	config.applyDefaults(cluster)
+	return config, config.validate()
+}
+
 func main() {
-	options := struct {
-		Address     string   `goptions:"-A, --address, description='Address to listens on the TCP network'"`
-		Path        string   `goptions:"-P, --path, description='Path under which to expose metrics'"`
-		ClusterName string   `goptions:"-C, --cluster-name, description='Cluster name'"`
-		Nodes       []string `goptions:"-n, --node, description='Replication cluster nodes. May be specified more than once'"`
-		Port        string   `goptions:"-p, --port, description='TCP port that Postgres listens on'"`
-		User        string   `goptions:"-u, --user, description='User to connect as'"`
-		Password    string   `goptions:"-s, --password, description='Password to connect with'"`
-		Interval    int64    `goptions:"-i, --interval, description='Collecting metrics interval in seconds'"`
-		Verbosity   int      `goptions:"-V, --verbosity, description='Verbosity level (0 errors, 1 +warnings, 2 +infos, 3 +debugs)'"`
-		Version     bool     `goptions:"-v, --version, description='Output version information, then exit'"`
-		Help        bool     `goptions:"-h, --help, description='Show this help, then exit'"`
-	}{
-		Address:   ":9188",
-		Path:      "/metrics",
-		Port:      "6432",
-		Interval:  15,
-		Verbosity: 2,
+	options := Options{
+		Address:           ":9188",
+		Path:              "/metrics",
+		Port:              "6432",
+		Interval:          15,
+		NodeTimeout:       10,
+		LsnHistory:        240,
+		HeartbeatInterval: 1,
+		MaxOpenConns:      2,
+		MaxIdleConns:      1,
+		MinRefresh:        5,
+		DiscoveryExpiry:   10,
+		Verbosity:         2,
 	}
 	goptions.ParseAndFail(&options)
 	if options.Help {
@@ -59,57 +131,46 @@ func main() {
 		fmt.Printf("%s version %s\n", ProgramFullName, ProgramVersion)
 		os.Exit(0)
 	}
-	interval := options.Interval
 	log.Verbosity = options.Verbosity
 
-	if options.User == "" || options.Password == "" {
-		log.error("User and password are mandatory, exit.")
+	config, configErr := options.loadConfig()
+	if configErr != nil {
+		log.error("%v, exit.", configErr)
 		os.Exit(WrongParamsExitCode)
 	}
 
-	if len(options.Nodes) < 2 {
-		log.error("Nodes count is less than 2, exit.")
-		os.Exit(WrongParamsExitCode)
-	}
-	clusterName := options.ClusterName
-	if len(clusterName) < 1 {
-		clusterName = clusterHash(options.Nodes)
-	}
-
 	scheduler := tasks.New()
 	defer scheduler.Stop()
 
-	// manual injections framework ;)
-	var measurer = NewMeasurer(clusterName)
-	var dataSource = NewDataSource(measurer, options.Port, options.User, options.Password)
-	var cluster = NewCluster(dataSource, clusterName, options.Nodes)
-	// Add a task
-	_, schedulerErr := scheduler.Add(&tasks.Task{
-		Interval: time.Duration(interval) * time.Second,
-		TaskFunc: func() error {
-			measurer.updateRuntimeInfo(ProgramFullName, ProgramVersion, clusterName)
-			masterState, slaveStates, collectErr := cluster.queryForState()
-			if collectErr == nil {
-				log.debug("master %s current wal LSN %d (%s)", masterState.host, masterState.currentWalLsnBytes, masterState.currentWalLsn)
-				measurer.updateClusterState(masterState, slaveStates)
-				for _, slaveState := range *slaveStates {
-					slaveLag := cluster.calculateSlaveLag(*masterState, *slaveState)
-					measurer.updateSlaveLag(masterState, slaveState, slaveLag)
-					log.debug("slave %s receive lag %d, replay lag %d", slaveState.host, slaveLag.receiveLag, slaveLag.replayLag)
-				}
-			} else {
-				log.error("collecting cluster data error: %v", collectErr)
-			}
-			return nil
-		},
-	})
-	if schedulerErr != nil {
+	metrics := NewMetrics(prometheus.DefaultRegisterer, config.labelNames())
+	exporter := NewExporter(&options, scheduler, metrics)
+	if schedulerErr := exporter.start(config); schedulerErr != nil {
 		log.error("FAILED to schedule task: %v", schedulerErr)
 		os.Exit(TaskSchedulerFailureExitCode)
 	}
+	metrics.updateReload(true)
+	if options.OnScrape {
+		prometheus.MustRegister(exporter)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.info("SIGHUP received, reloading configuration")
+			if reloadErr := exporter.reload(); reloadErr != nil {
+				log.error("reloading configuration error: %v", reloadErr)
+			}
+		}
+	}()
 
-	log.info("Started %s%s, scraping cluster %s every %d seconds. PID: %d", options.Address, options.Path, clusterName, interval, os.Getpid())
+	log.info("Started %s%s, scraping %d cluster(s). PID: %d", options.Address, options.Path, len(config.Clusters), os.Getpid())
 	http.Handle(options.Path, promhttp.Handler())
+	http.HandleFunc("/-/reload", exporter.ServeReload)
+	http.HandleFunc("/probe", exporter.ServeProbe)
+	http.HandleFunc("/topology.json", exporter.ServeTopology)
+	http.HandleFunc("/topology.dot", exporter.ServeTopology)
+	http.HandleFunc("/topology.mmd", exporter.ServeTopology)
 	httpServerErr := http.ListenAndServe(options.Address, nil)
 	if httpServerErr != nil {
 		log.error("FAILED to start http server: %v", httpServerErr)
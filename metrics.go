@@ -1,131 +1,866 @@
 package main
 
 import (
+	"database/sql"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	namespace           = "pgrc" // postgres
-	programNameLabel    = "name"
-	programVersionLabel = "version"
-	clusterNameLabel    = "cluster_name"
-	inRecoveryLabel     = "in_rec"
-	successLabel        = "success"
-	hostLabel           = "host"
-	masterHostLabel     = "master_host"
-	queryLabel          = "query"
+	namespace             = "pgrc" // postgres
+	programNameLabel      = "name"
+	programVersionLabel   = "version"
+	clusterNameLabel      = "cluster_name"
+	inRecoveryLabel       = "in_rec"
+	successLabel          = "success"
+	hostLabel             = "host"
+	masterHostLabel       = "master_host"
+	hostsLabel            = "hosts"
+	categoryLabel         = "category"
+	queryLabel            = "query"
+	applicationLabel      = "application_name"
+	clientAddrLabel       = "client_addr"
+	stateLabel            = "state"
+	syncStateLabel        = "sync_state"
+	slotNameLabel         = "slot_name"
+	slotTypeLabel         = "slot_type"
+	walStatusLabel        = "wal_status"
+	serverVersionLabel    = "server_version"
+	upstreamHostLabel     = "upstream_host"
+	statusLabel           = "status"
+	syncMethodLabel       = "sync_method"
+	roleLabel             = "role"
+	systemIdentifierLabel = "system_identifier"
+	senderHostLabel       = "sender_host"
+	serverVersionNumLabel = "server_version_num"
 )
 
+// Metrics are shared by all the clusters, every metric has the cluster_name label and the clusters' extra labels
+// reservedLabelNames can't be used as the clusters' extra labels
+var reservedLabelNames = map[string]bool{
+	programNameLabel: true, programVersionLabel: true, clusterNameLabel: true, inRecoveryLabel: true, successLabel: true,
+	hostLabel: true, masterHostLabel: true, hostsLabel: true, queryLabel: true, categoryLabel: true, applicationLabel: true,
+	clientAddrLabel: true, stateLabel: true, syncStateLabel: true, slotNameLabel: true, slotTypeLabel: true, walStatusLabel: true,
+	serverVersionLabel: true, serverVersionNumLabel: true, upstreamHostLabel: true,
+	statusLabel: true, senderHostLabel: true, syncMethodLabel: true, roleLabel: true, systemIdentifierLabel: true,
+}
+
+type Metrics struct {
+	extraLabelNames                     []string
+	vecs                                []*prometheus.MetricVec
+	sampleAgeSeconds                    *prometheus.Desc
+	lastReloadSuccessful                prometheus.Gauge
+	lastReloadSuccessTimestampSeconds   prometheus.Gauge
+	buildInfo                           *prometheus.GaugeVec
+	nodeInfo                            *prometheus.GaugeVec
+	nodeVersionInfo                     *prometheus.GaugeVec
+	primaries                           *prometheus.GaugeVec
+	splitBrain                          *prometheus.GaugeVec
+	nodeUp                              *prometheus.GaugeVec
+	nodeCollectionErrorsTotal           *prometheus.CounterVec
+	nodeCollectionSeconds               *prometheus.GaugeVec
+	nodeCollectionTimeoutsTotal         *prometheus.CounterVec
+	nodeClockSkewSeconds                *prometheus.GaugeVec
+	nodeTimeline                        *prometheus.GaugeVec
+	nodeDiverged                        *prometheus.GaugeVec
+	nodeSystemIdentifierInfo            *prometheus.GaugeVec
+	nodeSystemIdentifierMismatch        *prometheus.GaugeVec
+	roleChangesTotal                    *prometheus.CounterVec
+	failoversTotal                      *prometheus.CounterVec
+	snapshotSpreadSeconds               *prometheus.GaugeVec
+	negativeLagAnomaliesTotal           *prometheus.CounterVec
+	pingSeconds                         *prometheus.GaugeVec
+	reconnectsCountTotal                *prometheus.CounterVec
+	queriesCountTotal                   *prometheus.CounterVec
+	lastQuerySeconds                    *prometheus.GaugeVec
+	currentWalLsnBytes                  *prometheus.GaugeVec
+	lastWalReceiveLsnBytes              *prometheus.GaugeVec
+	lastWalReplayLsnBytes               *prometheus.GaugeVec
+	walReceiverInfo                     *prometheus.GaugeVec
+	walReceiverStreaming                *prometheus.GaugeVec
+	walReceiverReceivedTimeline         *prometheus.GaugeVec
+	walReceiverLastMsgSendAgeSeconds    *prometheus.GaugeVec
+	walReceiverLastMsgReceiptAgeSeconds *prometheus.GaugeVec
+	walReceiverLatestEndLsnBytes        *prometheus.GaugeVec
+	walReceiverLatestEndAgeSeconds      *prometheus.GaugeVec
+	receiveLagBytes                     *prometheus.GaugeVec
+	replayLagBytes                      *prometheus.GaugeVec
+	replayLagSeconds                    *prometheus.GaugeVec
+	estimatedReceiveLagSeconds          *prometheus.GaugeVec
+	estimatedReplayLagSeconds           *prometheus.GaugeVec
+	heartbeatLagSeconds                 *prometheus.GaugeVec
+	upstreamReceiveLagBytes             *prometheus.GaugeVec
+	upstreamReplayLagBytes              *prometheus.GaugeVec
+	walSenderInfo                       *prometheus.GaugeVec
+	walSenderSentLsnBytes               *prometheus.GaugeVec
+	walSenderWriteLsnBytes              *prometheus.GaugeVec
+	walSenderFlushLsnBytes              *prometheus.GaugeVec
+	walSenderReplayLsnBytes             *prometheus.GaugeVec
+	walSenderWriteLagSeconds            *prometheus.GaugeVec
+	walSenderFlushLagSeconds            *prometheus.GaugeVec
+	walSenderReplayLagSeconds           *prometheus.GaugeVec
+	walSenderSyncPriority               *prometheus.GaugeVec
+	syncStandbysRequired                *prometheus.GaugeVec
+	syncStandbysConnected               *prometheus.GaugeVec
+	syncQuorumSatisfied                 *prometheus.GaugeVec
+	slotInfo                            *prometheus.GaugeVec
+	slotActive                          *prometheus.GaugeVec
+	slotSafeWalSizeBytes                *prometheus.GaugeVec
+	slotRetainedWalBytes                *prometheus.GaugeVec
+	slotInactiveRetainingWal            *prometheus.GaugeVec
+	poolOpenConnections                 *prometheus.GaugeVec
+	poolInUseConnections                *prometheus.GaugeVec
+	poolIdleConnections                 *prometheus.GaugeVec
+	poolMaxOpenConnections              *prometheus.GaugeVec
+	poolWaitCount                       *prometheus.CounterVec
+	poolWaitSeconds                     *prometheus.CounterVec
+	poolMaxIdleClosed                   *prometheus.CounterVec
+	poolMaxIdleTimeClosed               *prometheus.CounterVec
+	poolMaxLifetimeClosed               *prometheus.CounterVec
+}
+
+// Measurer updates the metrics of a single cluster
 type Measurer struct {
-	clusterName            string
-	buildInfo              *prometheus.GaugeVec
-	nodeInfo               *prometheus.GaugeVec
-	pingSeconds            *prometheus.GaugeVec
-	reconnectsCountTotal   *prometheus.CounterVec
-	queriesCountTotal      *prometheus.CounterVec
-	lastQuerySeconds       *prometheus.GaugeVec
-	currentWalLsnBytes     *prometheus.GaugeVec
-	lastWalReceiveLsnBytes *prometheus.GaugeVec
-	lastWalReplayLsnBytes  *prometheus.GaugeVec
-	receiveLagBytes        *prometheus.GaugeVec
-	replayLagBytes         *prometheus.GaugeVec
-}
-
-func NewMeasurer(clusterName string) *Measurer {
-	return &Measurer{
-		clusterName: clusterName,
+	*Metrics
+	clusterName string
+	// replaced on reload while the heartbeat task and the scrapes read them, see setClusterLabels
+	labelsMutex   sync.RWMutex
+	clusterLabels map[string]string
+	series        *SeriesTracker
+	// on scrape collection, see Collect
+	refresh      func()
+	minRefresh   time.Duration
+	refreshMutex sync.Mutex
+	refreshedAt  time.Time
+	// the pool totals exported last time, see updatePoolStats
+	poolTotals map[string]sql.DBStats
+}
+
+func NewMetrics(registerer prometheus.Registerer, extraLabelNames []string) *Metrics {
+	factory := promauto.With(registerer)
+	clusterLabels := func(names ...string) []string {
+		return append(append([]string{clusterNameLabel}, extraLabelNames...), names...)
+	}
+	// all the cluster metrics are remembered, so the series of a removed cluster or node can be deleted
+	var vecs []*prometheus.MetricVec
+	newGaugeVec := func(opts prometheus.GaugeOpts, labelNames []string) *prometheus.GaugeVec {
+		vec := factory.NewGaugeVec(opts, labelNames)
+		vecs = append(vecs, vec.MetricVec)
+		return vec
+	}
+	newCounterVec := func(opts prometheus.CounterOpts, labelNames []string) *prometheus.CounterVec {
+		vec := factory.NewCounterVec(opts, labelNames)
+		vecs = append(vecs, vec.MetricVec)
+		return vec
+	}
+	metrics := &Metrics{
+		extraLabelNames: extraLabelNames,
+
+		// exported by the on scrape collector only
+		sampleAgeSeconds: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "sample_age_seconds"),
+			"Seconds since the returned cluster metrics have been collected",
+			clusterLabels(), nil),
+
+		lastReloadSuccessful: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_last_reload_successful",
+			Help:      "Has the last configuration reload attempt been successful (1) or not (0)",
+		}),
 
-		buildInfo: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		lastReloadSuccessTimestampSeconds: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful configuration reload",
+		}),
+
+		buildInfo: newGaugeVec(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "build_info",
 			Help:      "Program build info",
-		}, []string{programNameLabel, programVersionLabel, clusterNameLabel}),
+		}, clusterLabels(programNameLabel, programVersionLabel)),
+
+		primaries: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cluster_primaries",
+			Help:      "Number of cluster nodes which are not in recovery mode",
+		}, clusterLabels()),
+
+		splitBrain: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cluster_split_brain",
+			Help:      "Are there more than one cluster nodes not in recovery mode (1) or not (0), hosts label lists them",
+		}, clusterLabels(hostsLabel)),
+
+		nodeUp: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "node_up",
+			Help:      "Has the last cluster node state collection been successful (1) or not (0)",
+		}, clusterLabels(hostLabel)),
+
+		nodeCollectionErrorsTotal: newCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "node_collection_errors_total",
+			Help:      "Cluster node state collection errors total count by category: connect, auth, timeout, query, parse",
+		}, clusterLabels(hostLabel, categoryLabel)),
+
+		nodeCollectionSeconds: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "node_collection_seconds",
+			Help:      "Cluster node last state collection duration seconds",
+		}, clusterLabels(hostLabel)),
 
-		nodeInfo: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		nodeCollectionTimeoutsTotal: newCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "node_collection_timeouts_total",
+			Help:      "Cluster node state collections which have exceeded the node timeout total count",
+		}, clusterLabels(hostLabel)),
+
+		nodeDiverged: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "node_diverged",
+			Help:      "Has the standby's wal forked from the master's timeline history (1) or not (0), the standby needs pg_rewind or a reclone then",
+		}, clusterLabels(hostLabel)),
+
+		nodeSystemIdentifierInfo: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "node_system_identifier_info",
+			Help:      "Cluster node system identifier - SELECT system_identifier FROM pg_control_system()",
+		}, clusterLabels(hostLabel, systemIdentifierLabel)),
+
+		nodeSystemIdentifierMismatch: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "node_system_identifier_mismatch",
+			Help:      "Does the cluster node belong to another database cluster (1) or not (0): its system identifier differs from the master's one (during a split-brain from the one shared by most of the nodes), its lag isn't calculated",
+		}, clusterLabels(hostLabel)),
+
+		nodeTimeline: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "node_timeline",
+			Help:      "Cluster node timeline: the master's current one (wal file name) or the standby's received one (pg_stat_wal_receiver.received_tli)",
+		}, clusterLabels(hostLabel)),
+
+		roleChangesTotal: newCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "role_changes_total",
+			Help:      "Cluster node role changes total count by the new role: primary, standby",
+		}, clusterLabels(hostLabel, roleLabel)),
+
+		failoversTotal: newCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "failovers_total",
+			Help:      "Cluster master host or master timeline changes total count",
+		}, clusterLabels()),
+
+		nodeClockSkewSeconds: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "node_clock_skew_seconds",
+			Help:      "Cluster node clock minus the exporter clock seconds: clock_timestamp() - now",
+		}, clusterLabels(hostLabel)),
+
+		snapshotSpreadSeconds: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cluster_snapshot_spread_seconds",
+			Help:      "Seconds between the first and the last wal location read during the last collection",
+		}, clusterLabels()),
+
+		negativeLagAnomaliesTotal: newCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "negative_lag_anomalies_total",
+			Help:      "Standby wal location ahead of the master's one (lag clamped to 0) total count (not counted during a split-brain)",
+		}, clusterLabels(hostLabel, masterHostLabel)),
+
+		nodeVersionInfo: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "node_version_info",
+			Help:      "Cluster node server version - SELECT current_setting('server_version_num'), current_setting('server_version')",
+		}, clusterLabels(hostLabel, serverVersionLabel, serverVersionNumLabel)),
+
+		nodeInfo: newGaugeVec(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "cluster_node_info",
 			Help:      "Cluster node info",
-		}, []string{clusterNameLabel, hostLabel, inRecoveryLabel}),
+		}, clusterLabels(hostLabel, inRecoveryLabel)),
 
-		reconnectsCountTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+		reconnectsCountTotal: newCounterVec(prometheus.CounterOpts{
 			Namespace: namespace,
 			Name:      "reconnects_count_total",
 			Help:      "Cluster node reconnects total count",
-		}, []string{clusterNameLabel, hostLabel}),
+		}, clusterLabels(hostLabel)),
 
-		queriesCountTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+		queriesCountTotal: newCounterVec(prometheus.CounterOpts{
 			Namespace: namespace,
 			Name:      "queries_count_total",
 			Help:      "All queries total count",
-		}, []string{clusterNameLabel, hostLabel, queryLabel, successLabel}),
+		}, clusterLabels(hostLabel, queryLabel, successLabel)),
 
-		lastQuerySeconds: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		lastQuerySeconds: newGaugeVec(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "last_query_seconds",
 			Help:      "Cluster node last query seconds",
-		}, []string{clusterNameLabel, hostLabel, queryLabel}),
+		}, clusterLabels(hostLabel, queryLabel)),
 
-		currentWalLsnBytes: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		currentWalLsnBytes: newGaugeVec(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "current_wal_lsn_bytes",
 			Help:      "The current write-ahead log write location: SELECT pg_current_wal_lsn()",
-		}, []string{clusterNameLabel, hostLabel, inRecoveryLabel}),
+		}, clusterLabels(hostLabel, inRecoveryLabel)),
 
-		lastWalReceiveLsnBytes: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		lastWalReceiveLsnBytes: newGaugeVec(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "last_wal_receive_lsn_bytes",
 			Help:      "The last write-ahead log location that has been received and synced to disk by streaming replication: SELECT pg_last_wal_receive_lsn()",
-		}, []string{clusterNameLabel, hostLabel, inRecoveryLabel}),
+		}, clusterLabels(hostLabel, inRecoveryLabel)),
 
-		lastWalReplayLsnBytes: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		lastWalReplayLsnBytes: newGaugeVec(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "last_wal_replay_lsn_bytes",
 			Help:      "The last write-ahead log location that has been replayed during recovery: SELECT pg_last_wal_replay_lsn()",
-		}, []string{clusterNameLabel, hostLabel, inRecoveryLabel}),
+		}, clusterLabels(hostLabel, inRecoveryLabel)),
+
+		walReceiverInfo: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "wal_receiver_info",
+			Help:      "Standby's wal receiver info - SELECT status, sender_host, slot_name FROM pg_stat_wal_receiver",
+		}, clusterLabels(hostLabel, statusLabel, senderHostLabel, slotNameLabel)),
 
-		receiveLagBytes: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		walReceiverStreaming: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "wal_receiver_streaming",
+			Help:      "Is the standby's wal receiver running and streaming (1) or not (0) - SELECT status FROM pg_stat_wal_receiver",
+		}, clusterLabels(hostLabel)),
+
+		walReceiverReceivedTimeline: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "wal_receiver_received_timeline",
+			Help:      "Timeline of the last write-ahead log location received and flushed to disk - SELECT received_tli FROM pg_stat_wal_receiver",
+		}, clusterLabels(hostLabel)),
+
+		walReceiverLastMsgSendAgeSeconds: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "wal_receiver_last_msg_send_age_seconds",
+			Help:      "Seconds since the last message received from the upstream has been sent (upstream's clock) - SELECT now() - last_msg_send_time FROM pg_stat_wal_receiver",
+		}, clusterLabels(hostLabel)),
+
+		walReceiverLastMsgReceiptAgeSeconds: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "wal_receiver_last_msg_receipt_age_seconds",
+			Help:      "Seconds since the last message has been received from the upstream - SELECT now() - last_msg_receipt_time FROM pg_stat_wal_receiver",
+		}, clusterLabels(hostLabel)),
+
+		walReceiverLatestEndLsnBytes: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "wal_receiver_latest_end_lsn_bytes",
+			Help:      "Last write-ahead log location reported to the upstream - SELECT latest_end_lsn FROM pg_stat_wal_receiver",
+		}, clusterLabels(hostLabel)),
+
+		walReceiverLatestEndAgeSeconds: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "wal_receiver_latest_end_age_seconds",
+			Help:      "Seconds since the last write-ahead log location has been reported to the upstream - SELECT now() - latest_end_time FROM pg_stat_wal_receiver",
+		}, clusterLabels(hostLabel)),
+
+		receiveLagBytes: newGaugeVec(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "receive_lag_bytes",
 			Help:      "Cluster node receive lag bytes: pg_current_wal_lsn() - pg_last_wal_receive_lsn()",
-		}, []string{clusterNameLabel, hostLabel, inRecoveryLabel, masterHostLabel}),
+		}, clusterLabels(hostLabel, inRecoveryLabel, masterHostLabel)),
 
-		replayLagBytes: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		replayLagBytes: newGaugeVec(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "replay_lag_bytes",
 			Help:      "Cluster node replay lag bytes: pg_last_wal_receive_lsn() - pg_last_wal_reply_lsn()",
-		}, []string{clusterNameLabel, hostLabel, inRecoveryLabel, masterHostLabel}),
+		}, clusterLabels(hostLabel, inRecoveryLabel, masterHostLabel)),
+
+		replayLagSeconds: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "replay_lag_seconds",
+			Help:      "Cluster node replay lag seconds: now() - pg_last_xact_replay_timestamp(), 0 if everything has been replayed",
+		}, clusterLabels(hostLabel, inRecoveryLabel, masterHostLabel)),
+
+		estimatedReceiveLagSeconds: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "receive_lag_estimated_seconds",
+			Help:      "Cluster node receive lag seconds estimated from the history of the master's current wal locations",
+		}, clusterLabels(hostLabel, inRecoveryLabel, masterHostLabel)),
+
+		estimatedReplayLagSeconds: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "replay_lag_estimated_seconds",
+			Help:      "Cluster node replay lag seconds estimated from the history of the master's current wal locations",
+		}, clusterLabels(hostLabel, inRecoveryLabel, masterHostLabel)),
+
+		heartbeatLagSeconds: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "heartbeat_lag_seconds",
+			Help:      "Cluster node end-to-end lag seconds: now() - the heartbeat timestamp written on the master",
+		}, clusterLabels(hostLabel, inRecoveryLabel, masterHostLabel)),
+
+		upstreamReceiveLagBytes: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "upstream_receive_lag_bytes",
+			Help:      "Cluster node receive lag bytes relative to its direct upstream (the master or a cascading standby)",
+		}, clusterLabels(hostLabel, upstreamHostLabel)),
+
+		upstreamReplayLagBytes: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "upstream_replay_lag_bytes",
+			Help:      "Cluster node replay lag bytes relative to its direct upstream (the master or a cascading standby)",
+		}, clusterLabels(hostLabel, upstreamHostLabel)),
+
+		walSenderInfo: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stat_replication_info",
+			Help:      "Master's wal sender info: SELECT state, sync_state FROM pg_stat_replication",
+		}, clusterLabels(hostLabel, applicationLabel, clientAddrLabel, stateLabel, syncStateLabel)),
+
+		walSenderSentLsnBytes: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stat_replication_sent_lsn_bytes",
+			Help:      "Last write-ahead log location sent on this connection: SELECT sent_lsn FROM pg_stat_replication",
+		}, clusterLabels(hostLabel, applicationLabel, clientAddrLabel)),
+
+		walSenderWriteLsnBytes: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stat_replication_write_lsn_bytes",
+			Help:      "Last write-ahead log location written to disk by this standby server: SELECT write_lsn FROM pg_stat_replication",
+		}, clusterLabels(hostLabel, applicationLabel, clientAddrLabel)),
+
+		walSenderFlushLsnBytes: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stat_replication_flush_lsn_bytes",
+			Help:      "Last write-ahead log location flushed to disk by this standby server: SELECT flush_lsn FROM pg_stat_replication",
+		}, clusterLabels(hostLabel, applicationLabel, clientAddrLabel)),
+
+		walSenderReplayLsnBytes: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stat_replication_replay_lsn_bytes",
+			Help:      "Last write-ahead log location replayed into the database on this standby server: SELECT replay_lsn FROM pg_stat_replication",
+		}, clusterLabels(hostLabel, applicationLabel, clientAddrLabel)),
+
+		walSenderWriteLagSeconds: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stat_replication_write_lag_seconds",
+			Help:      "Time elapsed between flushing recent WAL locally and receiving notification that this standby server has written it: SELECT write_lag FROM pg_stat_replication",
+		}, clusterLabels(hostLabel, applicationLabel, clientAddrLabel)),
+
+		walSenderFlushLagSeconds: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stat_replication_flush_lag_seconds",
+			Help:      "Time elapsed between flushing recent WAL locally and receiving notification that this standby server has written and flushed it: SELECT flush_lag FROM pg_stat_replication",
+		}, clusterLabels(hostLabel, applicationLabel, clientAddrLabel)),
+
+		walSenderReplayLagSeconds: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stat_replication_replay_lag_seconds",
+			Help:      "Time elapsed between flushing recent WAL locally and receiving notification that this standby server has written, flushed and applied it: SELECT replay_lag FROM pg_stat_replication",
+		}, clusterLabels(hostLabel, applicationLabel, clientAddrLabel)),
+
+		walSenderSyncPriority: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stat_replication_sync_priority",
+			Help:      "Priority of this standby server for being chosen as the synchronous standby in a priority-based synchronous replication: SELECT sync_priority FROM pg_stat_replication",
+		}, clusterLabels(hostLabel, applicationLabel, clientAddrLabel)),
+
+		syncStandbysRequired: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "sync_standbys_required",
+			Help:      "Number of synchronous standbys the master's commits wait for (num_sync of synchronous_standby_names), 0 if the replication is asynchronous",
+		}, clusterLabels(hostLabel, syncMethodLabel)),
+
+		syncStandbysConnected: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "sync_standbys_connected",
+			Help:      "Number of streaming standbys listed in synchronous_standby_names whose sync_state is sync or quorum",
+		}, clusterLabels(hostLabel, syncMethodLabel)),
+
+		syncQuorumSatisfied: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "sync_quorum_satisfied",
+			Help:      "Are enough synchronous standbys connected to confirm the master's commits (1) or not (0), commits hang otherwise",
+		}, clusterLabels(hostLabel, syncMethodLabel)),
+
+		slotInfo: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "replication_slot_info",
+			Help:      "Master's replication slot info: SELECT slot_type, wal_status FROM pg_replication_slots",
+		}, clusterLabels(hostLabel, slotNameLabel, slotTypeLabel, walStatusLabel)),
+
+		slotActive: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "replication_slot_active",
+			Help:      "Is the replication slot currently actively being used (1) or not (0): SELECT active FROM pg_replication_slots",
+		}, clusterLabels(hostLabel, slotNameLabel)),
+
+		slotSafeWalSizeBytes: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "replication_slot_safe_wal_size_bytes",
+			Help:      "The number of bytes that can be written to WAL such that the slot is not in danger of getting lost: SELECT safe_wal_size FROM pg_replication_slots",
+		}, clusterLabels(hostLabel, slotNameLabel)),
+
+		slotRetainedWalBytes: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "replication_slot_retained_wal_bytes",
+			Help:      "WAL bytes retained by the replication slot: pg_current_wal_lsn() - restart_lsn",
+		}, clusterLabels(hostLabel, slotNameLabel)),
+
+		slotInactiveRetainingWal: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "replication_slot_inactive_retaining_wal",
+			Help:      "Is the replication slot inactive while still retaining WAL (1) or not (0)",
+		}, clusterLabels(hostLabel, slotNameLabel)),
+
+		poolOpenConnections: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "pool_open_connections",
+			Help:      "Cluster node pool established connections, both in use and idle",
+		}, clusterLabels(hostLabel)),
+
+		poolInUseConnections: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "pool_in_use_connections",
+			Help:      "Cluster node pool connections currently in use",
+		}, clusterLabels(hostLabel)),
+
+		poolIdleConnections: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "pool_idle_connections",
+			Help:      "Cluster node pool idle connections",
+		}, clusterLabels(hostLabel)),
+
+		poolMaxOpenConnections: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "pool_max_open_connections",
+			Help:      "Cluster node pool maximum number of open connections",
+		}, clusterLabels(hostLabel)),
+
+		poolWaitCount: newCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pool_wait_count_total",
+			Help:      "Cluster node pool connections waited for total count, the handles closed on reconnects are included",
+		}, clusterLabels(hostLabel)),
+
+		poolWaitSeconds: newCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pool_wait_seconds_total",
+			Help:      "Cluster node pool seconds blocked waiting for a new connection total, the handles closed on reconnects are included",
+		}, clusterLabels(hostLabel)),
+
+		poolMaxIdleClosed: newCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pool_max_idle_closed_total",
+			Help:      "Cluster node pool connections closed due to max idle connections total count, the handles closed on reconnects are included",
+		}, clusterLabels(hostLabel)),
+
+		poolMaxIdleTimeClosed: newCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pool_max_idle_time_closed_total",
+			Help:      "Cluster node pool connections closed due to max idle time total count, the handles closed on reconnects are included",
+		}, clusterLabels(hostLabel)),
+
+		poolMaxLifetimeClosed: newCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pool_max_lifetime_closed_total",
+			Help:      "Cluster node pool connections closed due to max lifetime total count, the handles closed on reconnects are included",
+		}, clusterLabels(hostLabel)),
+	}
+	metrics.vecs = vecs
+	return metrics
+}
+
+// deleteCluster deletes all the series of the cluster
+func (m *Metrics) deleteCluster(clusterName string) {
+	for _, vec := range m.vecs {
+		vec.DeletePartialMatch(prometheus.Labels{clusterNameLabel: clusterName})
+	}
+}
+
+// deleteHost deletes all the series of the cluster's node
+func (m *Metrics) deleteHost(clusterName, host string) {
+	for _, vec := range m.vecs {
+		vec.DeletePartialMatch(prometheus.Labels{clusterNameLabel: clusterName, hostLabel: host})
+		vec.DeletePartialMatch(prometheus.Labels{clusterNameLabel: clusterName, masterHostLabel: host})
+		vec.DeletePartialMatch(prometheus.Labels{clusterNameLabel: clusterName, upstreamHostLabel: host})
+	}
+}
+
+// deleteHost deletes all the series of the cluster's node and forgets its pool totals
+func (m *Measurer) deleteHost(clusterName, host string) {
+	m.Metrics.deleteHost(clusterName, host)
+	delete(m.poolTotals, host)
+}
+
+func (m *Metrics) updateReload(success bool) {
+	m.lastReloadSuccessful.Set(boolToFloat(success))
+	if success {
+		m.lastReloadSuccessTimestampSeconds.SetToCurrentTime()
+	}
+}
+
+func NewMeasurer(metrics *Metrics, clusterName string, clusterLabels map[string]string) *Measurer {
+	return &Measurer{
+		Metrics:       metrics,
+		clusterName:   clusterName,
+		clusterLabels: clusterLabels,
+		series:        NewSeriesTracker(),
 	}
 }
 
-func (m *Measurer) updateRuntimeInfo(name, version, clusterName string) {
-	m.buildInfo.With(prometheus.Labels{programNameLabel: name, programVersionLabel: version, clusterNameLabel: clusterName}).Set(0)
+// labels adds the cluster name and the cluster's extra labels to the given ones
+func (m *Measurer) labels(labels prometheus.Labels) prometheus.Labels {
+	m.labelsMutex.RLock()
+	defer m.labelsMutex.RUnlock()
+	labels[clusterNameLabel] = m.clusterName
+	for _, name := range m.extraLabelNames {
+		labels[name] = m.clusterLabels[name]
+	}
+	return labels
+}
+
+// setClusterLabels replaces the cluster's extra labels, the series with the old values are deleted,
+// so they can't stay exported without being refreshed
+func (m *Measurer) setClusterLabels(clusterLabels map[string]string) {
+	m.labelsMutex.Lock()
+	m.clusterLabels = clusterLabels
+	m.labelsMutex.Unlock()
+	m.deleteCluster(m.clusterName)
+}
+
+func (m *Measurer) updateRuntimeInfo(name, version string) {
+	m.buildInfo.With(m.labels(prometheus.Labels{programNameLabel: name, programVersionLabel: version})).Set(0)
 }
 
 func (m *Measurer) updateQueryStats(host string, q string, milliseconds int64, success bool) {
 	if success {
 		sec := float64(milliseconds) / float64(1000)
-		m.lastQuerySeconds.With(prometheus.Labels{clusterNameLabel: m.clusterName, hostLabel: host, queryLabel: q}).Set(sec)
+		m.lastQuerySeconds.With(m.labels(prometheus.Labels{hostLabel: host, queryLabel: q})).Set(sec)
+	}
+	m.queriesCountTotal.With(m.labels(prometheus.Labels{hostLabel: host, queryLabel: q, successLabel: strconv.FormatBool(success)})).Inc()
+}
+
+func (m *Measurer) updateClusterState(state *ClusterState) {
+	for _, nodeState := range state.all() {
+		m.set(m.nodeCollectionSeconds, m.labels(prometheus.Labels{hostLabel: nodeState.host}), nodeState.collectionDuration.Seconds())
+		if nodeState.hasClockSkew {
+			m.set(m.nodeClockSkewSeconds, m.labels(prometheus.Labels{hostLabel: nodeState.host}), nodeState.clockSkew.Seconds())
+		}
+		if nodeState.err == nil {
+			m.set(m.nodeVersionInfo, m.labels(prometheus.Labels{hostLabel: nodeState.host, serverVersionLabel: nodeState.serverVersion, serverVersionNumLabel: strconv.Itoa(nodeState.serverVersionNum)}), 0)
+		}
+		if nodeState.systemIdentifier != "" {
+			m.set(m.nodeSystemIdentifierInfo, m.labels(prometheus.Labels{hostLabel: nodeState.host, systemIdentifierLabel: nodeState.systemIdentifier}), 0)
+			m.set(m.nodeSystemIdentifierMismatch, m.labels(prometheus.Labels{hostLabel: nodeState.host}), boolToFloat(state.foreign[nodeState.host] != nil))
+		}
+		if nodeState.hasTimeline {
+			m.set(m.nodeTimeline, m.labels(prometheus.Labels{hostLabel: nodeState.host}), float64(nodeState.timeline))
+		}
+		if nodeState.timedOut {
+			m.nodeCollectionTimeoutsTotal.With(m.labels(prometheus.Labels{hostLabel: nodeState.host})).Inc()
+		}
+	}
+	for _, masterState := range state.masters {
+		m.set(m.nodeUp, m.labels(prometheus.Labels{hostLabel: masterState.host}), 1)
+		m.set(m.nodeInfo, m.labels(prometheus.Labels{hostLabel: masterState.host, inRecoveryLabel: strconv.FormatBool(false)}), 0)
+		m.set(m.currentWalLsnBytes, m.labels(prometheus.Labels{hostLabel: masterState.host, inRecoveryLabel: strconv.FormatBool(false)}), float64(masterState.currentWalLsnBytes))
+	}
+	m.set(m.snapshotSpreadSeconds, m.labels(prometheus.Labels{}), state.snapshotSpread().Seconds())
+	m.updateRoleChanges(state.roleChanges)
+	m.set(m.primaries, m.labels(prometheus.Labels{}), float64(len(state.masters)))
+	m.set(m.splitBrain, m.labels(prometheus.Labels{hostsLabel: strings.Join(state.masterHosts(), ",")}), boolToFloat(state.isSplitBrain()))
+	for host := range state.foreign {
+		m.set(m.nodeUp, m.labels(prometheus.Labels{hostLabel: host}), 1)
+	}
+	for host, failedState := range state.failed {
+		m.set(m.nodeUp, m.labels(prometheus.Labels{hostLabel: host}), 0)
+		m.nodeCollectionErrorsTotal.With(m.labels(prometheus.Labels{hostLabel: host, categoryLabel: categorizeError(failedState.err)})).Inc()
+	}
+	for host, slaveState := range state.slaves {
+		m.set(m.nodeUp, m.labels(prometheus.Labels{hostLabel: host}), 1)
+		m.set(m.nodeInfo, m.labels(prometheus.Labels{hostLabel: host, inRecoveryLabel: strconv.FormatBool(true)}), 0)
+		m.set(m.lastWalReceiveLsnBytes, m.labels(prometheus.Labels{hostLabel: host, inRecoveryLabel: strconv.FormatBool(true)}), float64(slaveState.lastWalReceiveLsnBytes))
+		m.set(m.lastWalReplayLsnBytes, m.labels(prometheus.Labels{hostLabel: host, inRecoveryLabel: strconv.FormatBool(true)}), float64(slaveState.lastWalReplayLsnBytes))
+		m.updateWalReceiver(slaveState)
+		if diverged, known := state.isDiverged(slaveState); known {
+			m.set(m.nodeDiverged, m.labels(prometheus.Labels{hostLabel: host}), boolToFloat(diverged))
+		}
 	}
-	m.queriesCountTotal.With(prometheus.Labels{clusterNameLabel: m.clusterName, hostLabel: host, queryLabel: q, successLabel: strconv.FormatBool(success)}).Inc()
 }
 
-func (m *Measurer) updateClusterState(masterState *NodeState, slaveStates *map[string]*NodeState) {
-	m.nodeInfo.With(prometheus.Labels{clusterNameLabel: m.clusterName, hostLabel: masterState.host, inRecoveryLabel: strconv.FormatBool(false)}).Set(0)
-	m.currentWalLsnBytes.With(prometheus.Labels{clusterNameLabel: m.clusterName, hostLabel: masterState.host, inRecoveryLabel: strconv.FormatBool(false)}).Set(float64(masterState.currentWalLsnBytes))
-	for host, slaveState := range *slaveStates {
-		m.nodeInfo.With(prometheus.Labels{clusterNameLabel: m.clusterName, hostLabel: host, inRecoveryLabel: strconv.FormatBool(true)}).Set(0)
-		m.lastWalReceiveLsnBytes.With(prometheus.Labels{clusterNameLabel: m.clusterName, hostLabel: host, inRecoveryLabel: strconv.FormatBool(true)}).Set(float64(slaveState.lastWalReceiveLsnBytes))
-		m.lastWalReplayLsnBytes.With(prometheus.Labels{clusterNameLabel: m.clusterName, hostLabel: host, inRecoveryLabel: strconv.FormatBool(true)}).Set(float64(slaveState.lastWalReplayLsnBytes))
+func (m *Measurer) updateRoleChanges(changes *RoleChanges) {
+	// the counter exists from the start, so increase() sees the first failover
+	failovers := m.failoversTotal.With(m.labels(prometheus.Labels{}))
+	if changes == nil {
+		return
+	}
+	if changes.failover {
+		failovers.Inc()
+	}
+	for _, nodeState := range changes.changed {
+		role := primaryRole
+		if nodeState.isInRecovery {
+			role = standbyRole
+		}
+		m.roleChangesTotal.With(m.labels(prometheus.Labels{hostLabel: nodeState.host, roleLabel: role})).Inc()
 	}
 }
 
 func (m *Measurer) updateSlaveLag(masterState *NodeState, slaveState *NodeState, lag *SlaveLag) {
-	m.receiveLagBytes.With(prometheus.Labels{clusterNameLabel: m.clusterName, hostLabel: slaveState.host, masterHostLabel: masterState.host, inRecoveryLabel: strconv.FormatBool(true)}).Set(float64(lag.receiveLag))
-	m.replayLagBytes.With(prometheus.Labels{clusterNameLabel: m.clusterName, hostLabel: slaveState.host, masterHostLabel: masterState.host, inRecoveryLabel: strconv.FormatBool(true)}).Set(float64(lag.replayLag))
+	if lag.negative {
+		m.negativeLagAnomaliesTotal.With(m.labels(prometheus.Labels{hostLabel: slaveState.host, masterHostLabel: masterState.host})).Inc()
+	}
+	m.set(m.receiveLagBytes, m.labels(prometheus.Labels{hostLabel: slaveState.host, masterHostLabel: masterState.host, inRecoveryLabel: strconv.FormatBool(true)}), float64(lag.receiveLag))
+	m.set(m.replayLagBytes, m.labels(prometheus.Labels{hostLabel: slaveState.host, masterHostLabel: masterState.host, inRecoveryLabel: strconv.FormatBool(true)}), float64(lag.replayLag))
+	if lag.hasReplayLagSeconds {
+		m.set(m.replayLagSeconds, m.labels(prometheus.Labels{hostLabel: slaveState.host, masterHostLabel: masterState.host, inRecoveryLabel: strconv.FormatBool(true)}), lag.replayLagSeconds)
+	}
+	if lag.hasEstimatedReceiveLagSeconds {
+		m.set(m.estimatedReceiveLagSeconds, m.labels(prometheus.Labels{hostLabel: slaveState.host, masterHostLabel: masterState.host, inRecoveryLabel: strconv.FormatBool(true)}), lag.estimatedReceiveLagSeconds)
+	}
+	if lag.hasEstimatedReplayLagSeconds {
+		m.set(m.estimatedReplayLagSeconds, m.labels(prometheus.Labels{hostLabel: slaveState.host, masterHostLabel: masterState.host, inRecoveryLabel: strconv.FormatBool(true)}), lag.estimatedReplayLagSeconds)
+	}
+	if lag.hasHeartbeatLagSeconds {
+		m.set(m.heartbeatLagSeconds, m.labels(prometheus.Labels{hostLabel: slaveState.host, masterHostLabel: masterState.host, inRecoveryLabel: strconv.FormatBool(true)}), lag.heartbeatLagSeconds)
+	}
+}
+
+func (m *Measurer) updateWalReceiver(slaveState *NodeState) {
+	if !slaveState.hasWalReceiverStatus {
+		return
+	}
+	labels := m.labels(prometheus.Labels{hostLabel: slaveState.host})
+	m.set(m.walReceiverStreaming, labels, boolToFloat(slaveState.walReceiver.isStreaming()))
+	r := slaveState.walReceiver
+	if r == nil {
+		return
+	}
+	m.set(m.walReceiverInfo, m.labels(prometheus.Labels{hostLabel: slaveState.host, statusLabel: r.status, senderHostLabel: r.senderHost, slotNameLabel: r.slotName}), 0)
+	m.set(m.walReceiverReceivedTimeline, labels, float64(r.receivedTli))
+	if r.hasLastMsgSendAge {
+		m.set(m.walReceiverLastMsgSendAgeSeconds, labels, r.lastMsgSendAge)
+	}
+	if r.hasLastMsgReceiptAge {
+		m.set(m.walReceiverLastMsgReceiptAgeSeconds, labels, r.lastMsgReceiptAge)
+	}
+	m.set(m.walReceiverLatestEndLsnBytes, labels, float64(r.latestEndLsnBytes))
+	if r.hasLatestEndAge {
+		m.set(m.walReceiverLatestEndAgeSeconds, labels, r.latestEndAge)
+	}
+}
+
+func (m *Measurer) updateUpstreamLag(upstreamState *NodeState, slaveState *NodeState, lag *UpstreamLag) {
+	labels := m.labels(prometheus.Labels{hostLabel: slaveState.host, upstreamHostLabel: upstreamState.host})
+	m.set(m.upstreamReceiveLagBytes, labels, float64(lag.receiveLag))
+	m.set(m.upstreamReplayLagBytes, labels, float64(lag.replayLag))
+}
+
+func (m *Measurer) updateWalSenders(masterState *NodeState) {
+	for _, sender := range masterState.walSenders {
+		m.set(m.walSenderInfo, m.labels(prometheus.Labels{hostLabel: masterState.host, applicationLabel: sender.applicationName, clientAddrLabel: sender.clientAddr, stateLabel: sender.state, syncStateLabel: sender.syncState}), 0)
+		labels := m.labels(prometheus.Labels{hostLabel: masterState.host, applicationLabel: sender.applicationName, clientAddrLabel: sender.clientAddr})
+		m.set(m.walSenderSentLsnBytes, labels, float64(sender.sentLsnBytes))
+		m.set(m.walSenderWriteLsnBytes, labels, float64(sender.writeLsnBytes))
+		m.set(m.walSenderFlushLsnBytes, labels, float64(sender.flushLsnBytes))
+		m.set(m.walSenderReplayLsnBytes, labels, float64(sender.replayLsnBytes))
+		if sender.hasLag {
+			m.set(m.walSenderWriteLagSeconds, labels, sender.writeLagSeconds)
+			m.set(m.walSenderFlushLagSeconds, labels, sender.flushLagSeconds)
+			m.set(m.walSenderReplayLagSeconds, labels, sender.replayLagSeconds)
+		}
+		m.set(m.walSenderSyncPriority, labels, float64(sender.syncPriority))
+	}
+}
+
+func (m *Measurer) updateSyncQuorum(masterState *NodeState) {
+	if !masterState.hasSyncStandbyNames {
+		return
+	}
+	if masterState.syncStandbyNames == nil {
+		// asynchronous replication, nothing to wait for
+		labels := m.labels(prometheus.Labels{hostLabel: masterState.host, syncMethodLabel: ""})
+		m.set(m.syncStandbysRequired, labels, 0)
+		m.set(m.syncStandbysConnected, labels, 0)
+		m.set(m.syncQuorumSatisfied, labels, 1)
+		return
+	}
+	quorum := masterState.syncStandbyNames.evaluateQuorum(masterState.walSenders)
+	labels := m.labels(prometheus.Labels{hostLabel: masterState.host, syncMethodLabel: masterState.syncStandbyNames.method})
+	m.set(m.syncStandbysRequired, labels, float64(quorum.required))
+	m.set(m.syncStandbysConnected, labels, float64(quorum.connected))
+	m.set(m.syncQuorumSatisfied, labels, boolToFloat(quorum.satisfied))
+}
+
+func (m *Measurer) updateReplicationSlots(masterState *NodeState) {
+	for _, slot := range masterState.replicationSlots {
+		m.set(m.slotInfo, m.labels(prometheus.Labels{hostLabel: masterState.host, slotNameLabel: slot.slotName, slotTypeLabel: slot.slotType, walStatusLabel: slot.walStatus}), 0)
+		labels := m.labels(prometheus.Labels{hostLabel: masterState.host, slotNameLabel: slot.slotName})
+		m.set(m.slotActive, labels, boolToFloat(slot.active))
+		if slot.hasSafeWalSize {
+			m.set(m.slotSafeWalSizeBytes, labels, float64(slot.safeWalSize))
+		}
+		m.set(m.slotRetainedWalBytes, labels, float64(slot.retainedWalBytes))
+		m.set(m.slotInactiveRetainingWal, labels, boolToFloat(slot.isInactiveRetainingWal()))
+	}
+}
+
+func (m *Measurer) updatePoolStats(stats map[string]sql.DBStats) {
+	if m.poolTotals == nil {
+		m.poolTotals = make(map[string]sql.DBStats)
+	}
+	for host, hostStats := range stats {
+		labels := m.labels(prometheus.Labels{hostLabel: host})
+		m.set(m.poolOpenConnections, labels, float64(hostStats.OpenConnections))
+		m.set(m.poolInUseConnections, labels, float64(hostStats.InUse))
+		m.set(m.poolIdleConnections, labels, float64(hostStats.Idle))
+		m.set(m.poolMaxOpenConnections, labels, float64(hostStats.MaxOpenConnections))
+		// the totals are accumulated across the reconnects, the counters grow by the difference since the last update
+		previous := m.poolTotals[host]
+		m.poolWaitCount.With(labels).Add(totalDelta(hostStats.WaitCount, previous.WaitCount))
+		m.poolWaitSeconds.With(labels).Add(totalDelta(int64(hostStats.WaitDuration), int64(previous.WaitDuration)) / float64(time.Second))
+		m.poolMaxIdleClosed.With(labels).Add(totalDelta(hostStats.MaxIdleClosed, previous.MaxIdleClosed))
+		m.poolMaxIdleTimeClosed.With(labels).Add(totalDelta(hostStats.MaxIdleTimeClosed, previous.MaxIdleTimeClosed))
+		m.poolMaxLifetimeClosed.With(labels).Add(totalDelta(hostStats.MaxLifetimeClosed, previous.MaxLifetimeClosed))
+		m.poolTotals[host] = hostStats
+	}
+}
+
+// totalDelta returns the growth of a total, a smaller total (e.g. a removed and re-added host) starts from zero
+func totalDelta(current, previous int64) float64 {
+	if current < previous {
+		return float64(current)
+	}
+	return float64(current - previous)
+}
+
+// set sets the gauge and remembers its labels as refreshed during the current collection
+func (m *Measurer) set(vec *prometheus.GaugeVec, labels prometheus.Labels, value float64) {
+	vec.With(labels).Set(value)
+	m.series.refreshed(vec, labels)
+}
+
+func (m *Measurer) beginCollection() {
+	m.series.begin()
+}
+
+// endCollection deletes series which haven't been refreshed during the collection, e.g. after a failover
+// the former master's current_wal_lsn_bytes or lag series of a removed node
+func (m *Measurer) endCollection() {
+	for _, deleted := range m.series.end() {
+		log.debug("deleting stale series %v", deleted)
+	}
 }
 
 func (m *Measurer) incReconnects(host string) {
-	m.reconnectsCountTotal.With(prometheus.Labels{clusterNameLabel: m.clusterName, hostLabel: host}).Inc()
+	m.reconnectsCountTotal.With(m.labels(prometheus.Labels{hostLabel: host})).Inc()
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
 }
@@ -6,25 +6,34 @@ import (
 	"strings"
 )
 
+// PgLsnParseError is returned when a value isn't a valid pg_lsn
+type PgLsnParseError struct {
+	value  string
+	reason string
+}
+
+func (e *PgLsnParseError) Error() string {
+	return fmt.Sprintf("parsing pg_lsn=`%s` failed (%s), parser supports values between 0/0 and FFFFFFFF/FFFFFFFF", e.value, e.reason)
+}
+
 // https://pgpedia.info/p/pg_lsn.html
 func parsePgLsn(s string) (uint64, error) {
-	const supportInfo = "parser supports values between 0/0 and FFFFFFFF/FFFFFFFF"
 	if s == "" {
 		s = "0/0"
 	}
 	l := strings.SplitN(s, "/", 3)
 	if len(l) != 2 {
-		return 0, fmt.Errorf("parsing pg_lsn=`%s` failed (not two parts?), %s", s, supportInfo)
+		return 0, &PgLsnParseError{value: s, reason: "not two parts?"}
 	}
 
 	a, err := strconv.ParseUint(l[0], 16, 64)
 	if err != nil {
-		return 0, fmt.Errorf("parsing pg_lsn=`%s` failed (first part), %s", s, supportInfo)
+		return 0, &PgLsnParseError{value: s, reason: "first part"}
 	}
 
 	b, err := strconv.ParseUint(l[1], 16, 64)
 	if err != nil {
-		return 0, fmt.Errorf("parsing pg_lsn=`%s` failed (second part), %s", s, supportInfo)
+		return 0, &PgLsnParseError{value: s, reason: "second part"}
 	}
 
 	return a<<32 + b, nil
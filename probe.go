@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+// ServeProbe handles GET /probe?auth_module=...&cluster=...&node=...&node=...,
+// the given nodes are collected synchronously and their metrics are returned from a fresh registry
+func (e *Exporter) ServeProbe(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	hosts := params["node"]
+	if len(hosts) == 0 {
+		http.Error(w, "node parameter is missing", http.StatusBadRequest)
+		return
+	}
+	clusterConfig, err := e.probeClusterConfig(params.Get("auth_module"), params.Get("cluster"), hosts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry, nil)
+	// reloads are the process' business, not the probe's
+	registry.Unregister(metrics.lastReloadSuccessful)
+	registry.Unregister(metrics.lastReloadSuccessTimestampSeconds)
+	measurer := NewMeasurer(metrics, clusterConfig.Name, nil)
+	dataSource := NewDataSource(measurer, clusterConfig)
+	defer dataSource.close()
+	cluster := NewCluster(dataSource, clusterConfig.Name, clusterConfig.hosts(), time.Duration(clusterConfig.NodeTimeout)*time.Second, 0)
+
+	measurer.updateRuntimeInfo(ProgramFullName, ProgramVersion)
+	collectClusterMetrics(cluster, measurer)
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+func (e *Exporter) probeClusterConfig(authModuleName string, clusterName string, hosts []string) (*ClusterConfig, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	authModule := e.config.AuthModules[authModuleName]
+	if authModule == nil {
+		return nil, fmt.Errorf("unknown auth module `%s`", authModuleName)
+	}
+	if clusterName == "" {
+		clusterName = clusterHash(append([]string(nil), hosts...))
+	}
+	return authModule.probeClusterConfig(clusterName, hosts, e.options.clusterDefaults()), nil
+}
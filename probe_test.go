@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExporter_ServeProbe(t *testing.T) {
+	options := &Options{Port: "6432", NodeTimeout: 5}
+	config := &Config{AuthModules: map[string]*AuthModule{
+		// nobody listens on the port, the probed nodes are down
+		"monitor": {User: "monitor", Password: "secret", Port: "1", DBName: "postgres", SSLMode: "disable"},
+	}}
+	exporter := NewExporter(options, nil, nil)
+	exporter.config = config
+	probe := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		exporter.ServeProbe(w, httptest.NewRequest(http.MethodGet, "/probe?"+query, nil))
+		return w
+	}
+
+	w := probe("auth_module=monitor")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "node parameter is missing")
+
+	w = probe("node=127.0.0.1")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "unknown auth module ``")
+
+	w = probe("auth_module=other&node=127.0.0.1")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "unknown auth module `other`")
+
+	w = probe("auth_module=monitor&cluster=orders&node=127.0.0.1&node=127.0.0.2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `pgrc_node_up{cluster_name="orders",host="127.0.0.1"} 0`)
+	assert.Contains(t, body, `pgrc_node_up{cluster_name="orders",host="127.0.0.2"} 0`)
+	// a fresh registry per request: no reload gauges, no other probe's series
+	assert.NotContains(t, body, "pgrc_config_last_reload")
+	w = probe("auth_module=monitor&node=127.0.0.3")
+	assert.Equal(t, http.StatusOK, w.Code)
+	body = w.Body.String()
+	assert.Contains(t, body, `pgrc_node_up{cluster_name="`+clusterHash([]string{"127.0.0.3"})+`",host="127.0.0.3"} 0`)
+	assert.NotContains(t, body, "orders")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// serverVersionQuery is run once per connection, the node's queries depend on its result
+const serverVersionQuery = "SELECT current_setting('server_version_num'), current_setting('server_version')"
+
+// QueryCatalog holds the queries matching a server version:
+// PostgreSQL 10 renamed the xlog functions and pg_stat_replication columns, added the replication lag columns;
+// PostgreSQL 13 added wal_status and safe_wal_size to pg_replication_slots
+type QueryCatalog struct {
+	serverVersionNum int
+	serverVersion    string
+	state            string
+	currentWalLsn    string
+	walSenders       string
+	replicationSlots string
+	// empty if pg_stat_wal_receiver isn't available
+	walReceiver string
+	// empty if pg_control_system() isn't available
+	systemIdentifier string
+	// format of the query reading a timeline's history file, the timeline is its argument
+	timelineHistory string
+	// the standby's own timeline from its control file, empty if pg_control_checkpoint() isn't available
+	standbyTimeline string
+	// pg_stat_replication has the write_lag, flush_lag and replay_lag columns
+	hasReplicationLag bool
+}
+
+func NewQueryCatalog(serverVersionNum int, serverVersion string) *QueryCatalog {
+	c := &QueryCatalog{serverVersionNum: serverVersionNum, serverVersion: serverVersion}
+	current, receive, replay, location, walFile := "pg_current_wal_lsn()", "pg_last_wal_receive_lsn()", "pg_last_wal_replay_lsn()", "lsn", "pg_walfile_name"
+	if serverVersionNum < 100000 {
+		current, receive, replay, location, walFile = "pg_current_xlog_location()", "pg_last_xlog_receive_location()", "pg_last_xlog_replay_location()", "location", "pg_xlogfile_name"
+	}
+	// pg_current_wal_lsn() can't be called during recovery, the receive and replay locations are NULL on a master;
+	// the master's timeline is the wal file name's prefix, pg_control_checkpoint() would require extra privileges
+	// https://www.postgresql.org/docs/current/functions-admin.html
+	c.state = fmt.Sprintf("SELECT pg_is_in_recovery()::TEXT, "+
+		"CASE WHEN pg_is_in_recovery() THEN '0/0' ELSE %[1]s::TEXT END, "+
+		"COALESCE(%[2]s,'0/0')::TEXT, COALESCE(%[3]s,'0/0')::TEXT, "+
+		"COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())::TEXT,''), "+
+		"EXTRACT(EPOCH FROM clock_timestamp())::TEXT, current_setting('synchronous_standby_names'), "+
+		"CASE WHEN pg_is_in_recovery() THEN '' ELSE %[4]s(%[1]s) END", current, receive, replay, walFile)
+	c.currentWalLsn = fmt.Sprintf("SELECT COALESCE(%s,'0/0')::TEXT", current)
+	// https://www.postgresql.org/docs/current/monitoring-stats.html#MONITORING-PG-STAT-REPLICATION-VIEW
+	// client_addr::TEXT would append the netmask, host() returns the bare address
+	c.hasReplicationLag = serverVersionNum >= 100000
+	lags := "COALESCE(EXTRACT(EPOCH FROM write_lag),0)::TEXT, COALESCE(EXTRACT(EPOCH FROM flush_lag),0)::TEXT, COALESCE(EXTRACT(EPOCH FROM replay_lag),0)::TEXT"
+	if !c.hasReplicationLag {
+		lags = "NULL, NULL, NULL"
+	}
+	c.walSenders = fmt.Sprintf("SELECT COALESCE(application_name,''), COALESCE(host(client_addr),''), COALESCE(state,''), COALESCE(sync_state,''), "+
+		"COALESCE(sent_%[1]s,'0/0')::TEXT, COALESCE(write_%[1]s,'0/0')::TEXT, COALESCE(flush_%[1]s,'0/0')::TEXT, COALESCE(replay_%[1]s,'0/0')::TEXT, "+
+		"%[2]s, COALESCE(sync_priority,0)::TEXT FROM pg_stat_replication", location, lags)
+	// https://www.postgresql.org/docs/current/view-pg-replication-slots.html
+	slotStatus := "COALESCE(wal_status,''), safe_wal_size::TEXT"
+	if serverVersionNum < 130000 {
+		slotStatus = "'', NULL"
+	}
+	c.replicationSlots = fmt.Sprintf("SELECT slot_name::TEXT, slot_type, active::TEXT, %s, COALESCE(restart_lsn,'0/0')::TEXT "+
+		"FROM pg_replication_slots", slotStatus)
+	// https://www.postgresql.org/docs/current/monitoring-stats.html#MONITORING-PG-STAT-WAL-RECEIVER-VIEW
+	// sender_host and sender_port are available since PostgreSQL 11, before they are parsed from conninfo
+	sender := "COALESCE(sender_host,''), COALESCE(sender_port::TEXT,'')"
+	if serverVersionNum < 110000 {
+		sender = "'', ''"
+	}
+	if serverVersionNum >= 90600 {
+		c.walReceiver = fmt.Sprintf("SELECT %s, COALESCE(conninfo,''), COALESCE(status,''), COALESCE(received_tli,0)::TEXT, "+
+			"COALESCE(EXTRACT(EPOCH FROM now() - last_msg_send_time)::TEXT,''), COALESCE(EXTRACT(EPOCH FROM now() - last_msg_receipt_time)::TEXT,''), "+
+			"COALESCE(latest_end_lsn,'0/0')::TEXT, COALESCE(EXTRACT(EPOCH FROM now() - latest_end_time)::TEXT,''), COALESCE(slot_name,'') "+
+			"FROM pg_stat_wal_receiver", sender)
+	}
+	// https://www.postgresql.org/docs/current/functions-info.html#FUNCTIONS-PG-CONTROL-SYSTEM
+	if serverVersionNum >= 90600 {
+		c.systemIdentifier = "SELECT system_identifier::TEXT FROM pg_control_system()"
+		// the last restartpoint's timeline lags behind the replay, the minimum recovery point's one follows it
+		c.standbyTimeline = "SELECT GREATEST(c.timeline_id, r.min_recovery_end_timeline)::TEXT FROM pg_control_checkpoint() c, pg_control_recovery() r"
+	}
+	// https://www.postgresql.org/docs/current/continuous-archiving.html#BACKUP-TIMELINES
+	walDir := "pg_wal"
+	if serverVersionNum < 100000 {
+		walDir = "pg_xlog"
+	}
+	c.timelineHistory = "SELECT pg_read_file('" + walDir + "/%08X.history')"
+	return c
+}
+
+// parseServerVersion parses the serverVersionQuery result row
+func parseServerVersion(row []string) (*QueryCatalog, error) {
+	if len(row) != 2 {
+		return nil, fmt.Errorf("unexpected columns count: %d", len(row))
+	}
+	versionNum, err := strconv.Atoi(row[0])
+	if err != nil {
+		return nil, err
+	}
+	return NewQueryCatalog(versionNum, row[1]), nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestQueryCatalog_parseServerVersion(t *testing.T) {
+	c, err := parseServerVersion([]string{"90624", "9.6.24"})
+	assert.NoError(t, err)
+	assert.Equal(t, 90624, c.serverVersionNum)
+	assert.Equal(t, "9.6.24", c.serverVersion)
+	assert.Contains(t, c.state, "pg_current_xlog_location()")
+	assert.Contains(t, c.state, "pg_last_xlog_replay_location()")
+	assert.Contains(t, c.walSenders, "sent_location")
+	assert.Contains(t, c.walSenders, "host(client_addr)")
+	assert.NotContains(t, c.walSenders, "replay_lag")
+	assert.False(t, c.hasReplicationLag)
+	assert.NotContains(t, c.replicationSlots, "wal_status")
+	assert.Equal(t, "SELECT pg_read_file('pg_xlog/0000000A.history')", fmt.Sprintf(c.timelineHistory, 10))
+	assert.Contains(t, c.standbyTimeline, "pg_control_checkpoint()")
+
+	c, err = parseServerVersion([]string{"120017", "12.17"})
+	assert.NoError(t, err)
+	assert.Contains(t, c.currentWalLsn, "pg_current_wal_lsn()")
+	assert.Contains(t, c.walSenders, "replay_lag")
+	assert.True(t, c.hasReplicationLag)
+	assert.NotContains(t, c.replicationSlots, "safe_wal_size")
+
+	c, err = parseServerVersion([]string{"160002", "16.2 (Debian 16.2-1.pgdg120+2)"})
+	assert.NoError(t, err)
+	assert.Contains(t, c.replicationSlots, "safe_wal_size")
+	assert.Equal(t, "SELECT pg_read_file('pg_wal/00000002.history')", fmt.Sprintf(c.timelineHistory, 2))
+
+	_, err = parseServerVersion([]string{"x", "?"})
+	assert.Error(t, err)
+}
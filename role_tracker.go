@@ -0,0 +1,56 @@
+package main
+
+// RoleTracker remembers the nodes' roles and the master's timeline across the collections, so failovers can be counted
+type RoleTracker struct {
+	// host -> is the node a master
+	masters map[string]bool
+	// the last master known without a split-brain
+	masterHost     string
+	masterTimeline int64
+}
+
+// RoleChanges are the events detected by the last collection
+type RoleChanges struct {
+	// nodes which have changed their role since they were seen the last time
+	changed []*NodeState
+	// the master host or its timeline has changed
+	failover bool
+}
+
+func NewRoleTracker() *RoleTracker {
+	return &RoleTracker{masters: make(map[string]bool)}
+}
+
+// track compares the state with the previous ones, failed nodes keep their last known role
+func (t *RoleTracker) track(state *ClusterState) *RoleChanges {
+	changes := &RoleChanges{}
+	for _, nodeState := range state.all() {
+		if nodeState.err != nil {
+			continue
+		}
+		isMaster := !nodeState.isInRecovery
+		if wasMaster, known := t.masters[nodeState.host]; known && wasMaster != isMaster {
+			changes.changed = append(changes.changed, nodeState)
+		}
+		t.masters[nodeState.host] = isMaster
+	}
+	// during a split-brain nobody knows which master is the right one, the last known one stays
+	if len(state.masters) != 1 {
+		return changes
+	}
+	master := state.masters[0]
+	if t.masterHost != "" && master.host != t.masterHost {
+		changes.failover = true
+	} else if master.hasTimeline && t.masterTimeline != 0 && master.timeline != t.masterTimeline {
+		// e.g. the master has been demoted and promoted again, or restored from a backup
+		changes.failover = true
+	}
+	t.masterHost = master.host
+	t.masterTimeline = master.timeline
+	return changes
+}
+
+// forget removes the node, it has been removed from the cluster
+func (t *RoleTracker) forget(host string) {
+	delete(t.masters, host)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRoleTracker_track(t *testing.T) {
+	tracker := NewRoleTracker()
+	newState := func(masterHost string, timeline int64, slaveHosts ...string) *ClusterState {
+		state := &ClusterState{slaves: make(map[string]*NodeState), failed: make(map[string]*NodeState)}
+		state.masters = []*NodeState{{host: masterHost, timeline: timeline, hasTimeline: true}}
+		for _, host := range slaveHosts {
+			state.slaves[host] = &NodeState{host: host, isInRecovery: true}
+		}
+		return state
+	}
+
+	changes := tracker.track(newState("node-1", 1, "node-2"))
+	assert.False(t, changes.failover)
+	assert.Empty(t, changes.changed)
+
+	// the former master is down, its role is unknown
+	state := newState("node-2", 2)
+	state.failed["node-1"] = &NodeState{host: "node-1", err: errors.New("connection refused")}
+	changes = tracker.track(state)
+	assert.True(t, changes.failover)
+	assert.Len(t, changes.changed, 1)
+	assert.Equal(t, "node-2", changes.changed[0].host)
+
+	// the former master is back as a standby
+	changes = tracker.track(newState("node-2", 2, "node-1"))
+	assert.False(t, changes.failover)
+	assert.Len(t, changes.changed, 1)
+	assert.Equal(t, "node-1", changes.changed[0].host)
+
+	// the same master on a new timeline
+	changes = tracker.track(newState("node-2", 3, "node-1"))
+	assert.True(t, changes.failover)
+	assert.Empty(t, changes.changed)
+
+	// split-brain keeps the last known master
+	state = newState("node-2", 3)
+	state.masters = append(state.masters, &NodeState{host: "node-1", timeline: 3, hasTimeline: true})
+	changes = tracker.track(state)
+	assert.False(t, changes.failover)
+	assert.Len(t, changes.changed, 1)
+	assert.Equal(t, "node-2", tracker.masterHost)
+}
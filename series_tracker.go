@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sort"
+	"strings"
+)
+
+// SeriesTracker remembers the label sets written to gauges during a collection, series written during the previous
+// collection but not refreshed in the current one are deleted when it ends
+type SeriesTracker struct {
+	previous map[*prometheus.GaugeVec]map[string]prometheus.Labels
+	current  map[*prometheus.GaugeVec]map[string]prometheus.Labels
+}
+
+func NewSeriesTracker() *SeriesTracker {
+	return &SeriesTracker{
+		previous: make(map[*prometheus.GaugeVec]map[string]prometheus.Labels),
+		current:  make(map[*prometheus.GaugeVec]map[string]prometheus.Labels),
+	}
+}
+
+func labelsKey(labels prometheus.Labels) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(labels[k])
+		sb.WriteByte(0xff)
+	}
+	return sb.String()
+}
+
+func (t *SeriesTracker) begin() {
+	t.current = make(map[*prometheus.GaugeVec]map[string]prometheus.Labels)
+}
+
+func (t *SeriesTracker) refreshed(vec *prometheus.GaugeVec, labels prometheus.Labels) {
+	if t.current[vec] == nil {
+		t.current[vec] = make(map[string]prometheus.Labels)
+	}
+	t.current[vec][labelsKey(labels)] = labels
+}
+
+// end deletes stale series and returns their labels
+func (t *SeriesTracker) end() []prometheus.Labels {
+	var deleted []prometheus.Labels
+	for vec, series := range t.previous {
+		for key, labels := range series {
+			if _, ok := t.current[vec][key]; !ok {
+				vec.Delete(labels)
+				deleted = append(deleted, labels)
+			}
+		}
+	}
+	t.previous = t.current
+	return deleted
+}
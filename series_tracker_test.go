@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSeriesTracker_end(t *testing.T) {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_current_wal_lsn_bytes"}, []string{hostLabel, inRecoveryLabel})
+	tracker := NewSeriesTracker()
+	set := func(host, inRec string) {
+		labels := prometheus.Labels{hostLabel: host, inRecoveryLabel: inRec}
+		vec.With(labels).Set(1)
+		tracker.refreshed(vec, labels)
+	}
+
+	tracker.begin()
+	set("node1", "false")
+	set("node2", "true")
+	assert.Empty(t, tracker.end())
+	assert.Equal(t, 2, testutil.CollectAndCount(vec))
+
+	// failover: node1 became a standby
+	tracker.begin()
+	set("node1", "true")
+	set("node2", "false")
+	deleted := tracker.end()
+	assert.Len(t, deleted, 2)
+	assert.Equal(t, 2, testutil.CollectAndCount(vec))
+
+	// node2 removed
+	tracker.begin()
+	set("node1", "true")
+	assert.Equal(t, []prometheus.Labels{{hostLabel: "node2", inRecoveryLabel: "false"}}, tracker.end())
+	assert.Equal(t, 1, testutil.CollectAndCount(vec))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	syncMethodFirst = "first"
+	syncMethodAny   = "any"
+)
+
+// SyncStandbyNames is the parsed synchronous_standby_names setting:
+// [FIRST] num_sync ( standby_name [, ...] ), ANY num_sync ( standby_name [, ...] ) or standby_name [, ...]
+// https://www.postgresql.org/docs/current/runtime-config-replication.html#GUC-SYNCHRONOUS-STANDBY-NAMES
+type SyncStandbyNames struct {
+	method  string
+	numSync int
+	names   []string
+}
+
+// SyncQuorumState tells if the master's commits can be confirmed by enough synchronous standbys
+type SyncQuorumState struct {
+	required  int
+	connected int
+	satisfied bool
+}
+
+// parseSyncStandbyNames returns nil if the setting is empty, the replication is asynchronous then
+func parseSyncStandbyNames(setting string) (*SyncStandbyNames, error) {
+	tokens, err := tokenizeSyncStandbyNames(setting)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	s := &SyncStandbyNames{method: syncMethodFirst, numSync: 1}
+	// FIRST and ANY are keywords only if followed by a number, otherwise they are standby names
+	if len(tokens) > 2 && tokens[1].isNumber && (strings.EqualFold(tokens[0].value, "first") || strings.EqualFold(tokens[0].value, "any")) && !tokens[0].quoted {
+		s.method = strings.ToLower(tokens[0].value)
+		tokens = tokens[1:]
+	}
+	if len(tokens) > 1 && tokens[0].isNumber && tokens[1].value == "(" && !tokens[1].quoted {
+		if s.numSync, err = strconv.Atoi(tokens[0].value); err != nil {
+			return nil, err
+		}
+		if tokens[len(tokens)-1].value != ")" || tokens[len(tokens)-1].quoted {
+			return nil, fmt.Errorf("missing closing parenthesis in `%s`", setting)
+		}
+		tokens = tokens[2 : len(tokens)-1]
+	} else if s.method == syncMethodAny {
+		return nil, fmt.Errorf("ANY requires the number of standbys in `%s`", setting)
+	}
+	for i, token := range tokens {
+		if i%2 == 1 {
+			if token.value != "," || token.quoted {
+				return nil, fmt.Errorf("unexpected `%s` in `%s`", token.value, setting)
+			}
+			continue
+		}
+		if !token.quoted && (token.value == "," || token.value == "(" || token.value == ")") {
+			return nil, fmt.Errorf("unexpected `%s` in `%s`", token.value, setting)
+		}
+		s.names = append(s.names, token.value)
+	}
+	if len(s.names) == 0 || len(tokens)%2 == 0 {
+		return nil, fmt.Errorf("missing standby name in `%s`", setting)
+	}
+	if s.numSync < 1 {
+		return nil, fmt.Errorf("number of synchronous standbys must be positive in `%s`", setting)
+	}
+	return s, nil
+}
+
+type syncStandbyNamesToken struct {
+	value    string
+	quoted   bool
+	isNumber bool
+}
+
+func tokenizeSyncStandbyNames(setting string) ([]syncStandbyNamesToken, error) {
+	var tokens []syncStandbyNamesToken
+	for i := 0; i < len(setting); {
+		c := setting[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == ',' || c == '*':
+			tokens = append(tokens, syncStandbyNamesToken{value: string(c)})
+			i++
+		case c == '"':
+			// "" is an escaped double quote
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(setting) {
+					return nil, fmt.Errorf("unterminated quoted name in `%s`", setting)
+				}
+				if setting[i] == '"' {
+					if i+1 < len(setting) && setting[i+1] == '"' {
+						b.WriteByte('"')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteByte(setting[i])
+				i++
+			}
+			tokens = append(tokens, syncStandbyNamesToken{value: b.String(), quoted: true})
+		default:
+			start := i
+			for i < len(setting) && !strings.ContainsRune(" \t\n\r(),\"", rune(setting[i])) {
+				i++
+			}
+			value := setting[start:i]
+			_, err := strconv.Atoi(value)
+			tokens = append(tokens, syncStandbyNamesToken{value: value, isNumber: err == nil})
+		}
+	}
+	return tokens, nil
+}
+
+// matches tells if the wal sender's application_name is one of the names, the comparison is case-insensitive like Postgres' one
+func (s *SyncStandbyNames) matches(applicationName string) bool {
+	for _, name := range s.names {
+		if name == "*" || strings.EqualFold(name, applicationName) {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluateQuorum counts the streaming standbys the master waits for: sync ones with FIRST, quorum ones with ANY
+func (s *SyncStandbyNames) evaluateQuorum(senders []*WalSenderState) *SyncQuorumState {
+	state := &SyncQuorumState{required: s.numSync}
+	for _, sender := range senders {
+		if sender.state != "streaming" || !s.matches(sender.applicationName) {
+			continue
+		}
+		if sender.syncState == "sync" || sender.syncState == "quorum" {
+			state.connected++
+		}
+	}
+	state.satisfied = state.connected >= state.required
+	return state
+}
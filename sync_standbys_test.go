@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSyncStandbyNames_parse(t *testing.T) {
+	s, err := parseSyncStandbyNames("")
+	assert.NoError(t, err)
+	assert.Nil(t, s)
+
+	s, err = parseSyncStandbyNames("ANY 2 (node_2, \"Node 3\", node_4)")
+	assert.NoError(t, err)
+	assert.Equal(t, &SyncStandbyNames{method: syncMethodAny, numSync: 2, names: []string{"node_2", "Node 3", "node_4"}}, s)
+
+	s, err = parseSyncStandbyNames("first 1 (*)")
+	assert.NoError(t, err)
+	assert.Equal(t, &SyncStandbyNames{method: syncMethodFirst, numSync: 1, names: []string{"*"}}, s)
+
+	s, err = parseSyncStandbyNames("2 (s1, s2, s3)")
+	assert.NoError(t, err)
+	assert.Equal(t, &SyncStandbyNames{method: syncMethodFirst, numSync: 2, names: []string{"s1", "s2", "s3"}}, s)
+
+	// the pre 9.6 syntax, FIRST is a standby name here
+	s, err = parseSyncStandbyNames("first, second")
+	assert.NoError(t, err)
+	assert.Equal(t, &SyncStandbyNames{method: syncMethodFirst, numSync: 1, names: []string{"first", "second"}}, s)
+
+	for _, invalid := range []string{"ANY (s1)", "ANY 2 (s1, s2", "2 (s1,)", "s1 s2", "0 (s1)", "\"s1"} {
+		_, err = parseSyncStandbyNames(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestSyncStandbyNames_evaluateQuorum(t *testing.T) {
+	senders := []*WalSenderState{
+		{applicationName: "node_2", state: "streaming", syncState: "quorum"},
+		{applicationName: "NODE_3", state: "catchup", syncState: "quorum"},
+		{applicationName: "node_4", state: "streaming", syncState: "quorum"},
+		{applicationName: "backup", state: "streaming", syncState: "async"},
+	}
+	s, _ := parseSyncStandbyNames("ANY 2 (node_2, node_3, node_4)")
+	assert.Equal(t, &SyncQuorumState{required: 2, connected: 2, satisfied: true}, s.evaluateQuorum(senders))
+
+	s, _ = parseSyncStandbyNames("ANY 3 (node_2, node_3, node_4)")
+	assert.Equal(t, &SyncQuorumState{required: 3, connected: 2, satisfied: false}, s.evaluateQuorum(senders))
+
+	senders[0].syncState, senders[2].syncState = "sync", "potential"
+	s, _ = parseSyncStandbyNames("FIRST 1 (node_2, node_4)")
+	assert.Equal(t, &SyncQuorumState{required: 1, connected: 1, satisfied: true}, s.evaluateQuorum(senders))
+}
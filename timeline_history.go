@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TimelineHistoryEntry is a line of a timeline history file: the parent timeline and the wal location where it has been left
+// https://www.postgresql.org/docs/current/continuous-archiving.html#BACKUP-TIMELINES
+type TimelineHistoryEntry struct {
+	timeline         int64
+	switchpoint      string
+	switchpointBytes uint64
+}
+
+// parseTimelineHistory parses the `parentTLI<tab>switchpoint<tab>reason` lines, blank and # comment lines are skipped
+func parseTimelineHistory(content string) ([]*TimelineHistoryEntry, error) {
+	var history []*TimelineHistoryEntry
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("unexpected timeline history line: `%s`", line)
+		}
+		timeline, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse timeline of `%s`: %w", line, err)
+		}
+		switchpointBytes, err := parsePgLsn(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, &TimelineHistoryEntry{timeline: timeline, switchpoint: fields[1], switchpointBytes: switchpointBytes})
+	}
+	return history, nil
+}
+
+// isDiverged tells if the standby's wal has forked from the master's one, so it can't follow the master without
+// pg_rewind or a reclone; known is false if there isn't a single master or the timelines aren't known
+func (state *ClusterState) isDiverged(slave *NodeState) (diverged bool, known bool) {
+	if len(state.masters) != 1 {
+		return false, false
+	}
+	master := state.masters[0]
+	if !master.hasTimeline || !master.hasTimelineHistory || !slave.hasTimeline {
+		return false, false
+	}
+	if slave.timeline == master.timeline {
+		return false, true
+	}
+	if slave.timeline > master.timeline {
+		// the standby has been on a timeline the master has never been on
+		return true, true
+	}
+	position := slave.lastWalReceiveLsnBytes
+	if slave.lastWalReplayLsnBytes > position {
+		position = slave.lastWalReplayLsnBytes
+	}
+	for _, entry := range master.timelineHistory {
+		if entry.timeline == slave.timeline {
+			// the standby has written wal on its timeline past the master's switch to the next one
+			return position > entry.switchpointBytes, true
+		}
+	}
+	// the standby's timeline isn't the master's ancestor
+	return true, true
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTimelineHistory_parse(t *testing.T) {
+	history, err := parseTimelineHistory("1\t0/3000158\tno recovery target specified\n\n# comment\n2\t0/5000060\tbefore 2024-01-01 00:00:00+00\n")
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, int64(1), history[0].timeline)
+	assert.Equal(t, "0/3000158", history[0].switchpoint)
+	assert.Equal(t, uint64(0x3000158), history[0].switchpointBytes)
+	assert.Equal(t, int64(2), history[1].timeline)
+	assert.Equal(t, uint64(0x5000060), history[1].switchpointBytes)
+
+	history, err = parseTimelineHistory("")
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+
+	_, err = parseTimelineHistory("x\t0/3000158\treason")
+	assert.Error(t, err)
+	_, err = parseTimelineHistory("1\tx\treason")
+	assert.Error(t, err)
+	_, err = parseTimelineHistory("1")
+	assert.Error(t, err)
+}
+
+func TestClusterState_isDiverged(t *testing.T) {
+	history, _ := parseTimelineHistory("1\t0/3000000\tno recovery target specified\n2\t0/5000000\tno recovery target specified")
+	master := &NodeState{host: "node-1", timeline: 3, hasTimeline: true, timelineHistory: history, hasTimelineHistory: true}
+	state := &ClusterState{masters: []*NodeState{master}}
+	standby := func(timeline int64, lsn uint64) *NodeState {
+		return &NodeState{isInRecovery: true, timeline: timeline, hasTimeline: true, lastWalReceiveLsnBytes: lsn, lastWalReplayLsnBytes: lsn}
+	}
+
+	diverged, known := state.isDiverged(standby(3, 0x6000000))
+	assert.True(t, known)
+	assert.False(t, diverged)
+	// still on the parent timeline, before the switchpoint: it can follow the master
+	diverged, known = state.isDiverged(standby(2, 0x4000000))
+	assert.True(t, known)
+	assert.False(t, diverged)
+	// the former master has written past the switchpoint
+	diverged, _ = state.isDiverged(standby(2, 0x5000100))
+	assert.True(t, diverged)
+	diverged, _ = state.isDiverged(standby(1, 0x3000100))
+	assert.True(t, diverged)
+	// a timeline the master has never been on
+	diverged, _ = state.isDiverged(standby(4, 0x6000000))
+	assert.True(t, diverged)
+
+	_, known = state.isDiverged(&NodeState{isInRecovery: true})
+	assert.False(t, known)
+	master.hasTimelineHistory = false
+	_, known = state.isDiverged(standby(3, 0x6000000))
+	assert.False(t, known)
+	master.hasTimelineHistory = true
+	state.masters = append(state.masters, &NodeState{host: "node-2"})
+	_, known = state.isDiverged(standby(3, 0x6000000))
+	assert.False(t, known)
+}
+
+func TestNodeState_setStandbyTimeline(t *testing.T) {
+	history, _ := parseTimelineHistory("1\t0/3000000\tno recovery target specified\n2\t0/5000000\tno recovery target specified")
+	master := &NodeState{host: "node-1", timeline: 3, hasTimeline: true, timelineHistory: history, hasTimelineHistory: true}
+	state := &ClusterState{masters: []*NodeState{master}}
+
+	// the former master can't stream, it has no wal receiver row, its control file still points at timeline 2
+	formerMaster := &NodeState{host: "node-2", isInRecovery: true, lastWalReceiveLsnBytes: 0x5000100, lastWalReplayLsnBytes: 0x5000100}
+	formerMaster.setStandbyTimeline(2, true)
+	assert.True(t, formerMaster.hasTimeline)
+	assert.Equal(t, int64(2), formerMaster.timeline)
+	diverged, known := state.isDiverged(formerMaster)
+	assert.True(t, known)
+	assert.True(t, diverged)
+
+	// the streaming wal receiver's timeline is ahead of the control file's one
+	standby := &NodeState{host: "node-3", isInRecovery: true, walReceiver: &WalReceiverState{status: "streaming", receivedTli: 3}, lastWalReceiveLsnBytes: 0x6000000, lastWalReplayLsnBytes: 0x6000000}
+	standby.setStandbyTimeline(2, true)
+	assert.Equal(t, int64(3), standby.timeline)
+	diverged, _ = state.isDiverged(standby)
+	assert.False(t, diverged)
+
+	// neither is known
+	unknown := &NodeState{host: "node-4", isInRecovery: true, walReceiver: &WalReceiverState{status: "waiting", receivedTli: 2}}
+	unknown.setStandbyTimeline(0, false)
+	assert.False(t, unknown.hasTimeline)
+	_, known = state.isDiverged(unknown)
+	assert.False(t, known)
+}
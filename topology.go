@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	primaryRole = "primary"
+	standbyRole = "standby"
+	failedRole  = "failed"
+	foreignRole = "foreign"
+)
+
+// Topology is the replication graph of a cluster built from the last collected state
+type Topology struct {
+	Cluster    string          `json:"cluster"`
+	SplitBrain bool            `json:"split_brain"`
+	Nodes      []*TopologyNode `json:"nodes"`
+	Edges      []*TopologyEdge `json:"edges"`
+}
+
+type TopologyNode struct {
+	Host  string          `json:"host"`
+	Role  string          `json:"role"`
+	Error string          `json:"error,omitempty"`
+	Slots []*TopologySlot `json:"slots,omitempty"`
+}
+
+type TopologySlot struct {
+	Name             string `json:"name"`
+	Type             string `json:"type"`
+	Active           bool   `json:"active"`
+	RetainedWalBytes uint64 `json:"retained_wal_bytes"`
+}
+
+// TopologyEdge points from the upstream to the standby, the lag is relative to the upstream
+type TopologyEdge struct {
+	Upstream        string `json:"upstream"`
+	Standby         string `json:"standby"`
+	SyncState       string `json:"sync_state,omitempty"`
+	ReceiveLagBytes uint64 `json:"receive_lag_bytes"`
+	ReplayLagBytes  uint64 `json:"replay_lag_bytes"`
+	// the upstream's pg_stat_replication.replay_lag, known only if the upstream's wal sender matches the standby
+	ReplayLagSeconds *float64 `json:"replay_lag_seconds,omitempty"`
+}
+
+func buildTopology(clusterName string, state *ClusterState) *Topology {
+	topology := &Topology{Cluster: clusterName, SplitBrain: state.isSplitBrain(), Nodes: []*TopologyNode{}, Edges: []*TopologyEdge{}}
+	for _, master := range state.masters {
+		node := &TopologyNode{Host: master.host, Role: primaryRole}
+		for _, slot := range master.replicationSlots {
+			node.Slots = append(node.Slots, &TopologySlot{Name: slot.slotName, Type: slot.slotType, Active: slot.active, RetainedWalBytes: slot.retainedWalBytes})
+		}
+		topology.Nodes = append(topology.Nodes, node)
+	}
+	for _, slave := range sortedNodeStates(state.slaves) {
+		topology.Nodes = append(topology.Nodes, &TopologyNode{Host: slave.host, Role: standbyRole})
+		upstream := state.upstreamOf(slave)
+		if upstream == nil && len(state.masters) == 1 {
+			// the upstream is unknown (e.g. PostgreSQL 9.5), the only master is the best guess
+			upstream = state.masters[0]
+		}
+		if upstream == nil {
+			continue
+		}
+		lag := calculateUpstreamLag(*upstream, *slave)
+		edge := &TopologyEdge{Upstream: upstream.host, Standby: slave.host, ReceiveLagBytes: lag.receiveLag, ReplayLagBytes: lag.replayLag}
+		if sender := upstream.walSenderOf(slave.host); sender != nil {
+			edge.SyncState = sender.syncState
+			if sender.hasLag {
+				replayLagSeconds := sender.replayLagSeconds
+				edge.ReplayLagSeconds = &replayLagSeconds
+			}
+		}
+		topology.Edges = append(topology.Edges, edge)
+	}
+	for _, foreign := range sortedNodeStates(state.foreign) {
+		topology.Nodes = append(topology.Nodes, &TopologyNode{Host: foreign.host, Role: foreignRole})
+	}
+	for _, failed := range sortedNodeStates(state.failed) {
+		topology.Nodes = append(topology.Nodes, &TopologyNode{Host: failed.host, Role: failedRole, Error: failed.err.Error()})
+	}
+	return topology
+}
+
+func sortedNodeStates(states map[string]*NodeState) []*NodeState {
+	sorted := make([]*NodeState, 0, len(states))
+	for _, nodeState := range states {
+		sorted = append(sorted, nodeState)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].host < sorted[j].host })
+	return sorted
+}
+
+// walSenderOf returns the wal sender streaming to the host, the standby is recognized by its application_name
+// (primary_conninfo) or its client address, an IPv6 address may be written differently than host() prints it
+func (nodeState *NodeState) walSenderOf(host string) *WalSenderState {
+	address := net.ParseIP(host)
+	for _, sender := range nodeState.walSenders {
+		if sender.applicationName == host || sender.clientAddr == host || (address != nil && address.Equal(net.ParseIP(sender.clientAddr))) {
+			return sender
+		}
+	}
+	return nil
+}
+
+func (e *TopologyEdge) label() string {
+	label := fmt.Sprintf("receive lag %d B, replay lag %d B", e.ReceiveLagBytes, e.ReplayLagBytes)
+	if e.ReplayLagSeconds != nil {
+		label += fmt.Sprintf(", %.3f s", *e.ReplayLagSeconds)
+	}
+	if e.SyncState != "" {
+		label = e.SyncState + ", " + label
+	}
+	return label
+}
+
+// labelLines returns the node's label lines, the renderers escape and join them
+func (n *TopologyNode) labelLines() []string {
+	lines := []string{n.Host + " (" + n.Role + ")"}
+	for _, slot := range n.Slots {
+		lines = append(lines, fmt.Sprintf("slot %s active=%t retained %d B", slot.Name, slot.Active, slot.RetainedWalBytes))
+	}
+	return lines
+}
+
+var (
+	dotEscaper     = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	mermaidEscaper = strings.NewReplacer("#", "#35;", `"`, "#quot;", "<", "#lt;", ">", "#gt;")
+)
+
+// dotString quotes a DOT string, the lines are joined with DOT's \n
+func dotString(lines ...string) string {
+	escaped := make([]string, len(lines))
+	for i, line := range lines {
+		escaped[i] = dotEscaper.Replace(line)
+	}
+	return `"` + strings.Join(escaped, `\n`) + `"`
+}
+
+// mermaidString quotes a Mermaid label, the lines are joined with <br/>
+func mermaidString(lines ...string) string {
+	escaped := make([]string, len(lines))
+	for i, line := range lines {
+		escaped[i] = mermaidEscaper.Replace(line)
+	}
+	return `"` + strings.Join(escaped, "<br/>") + `"`
+}
+
+// renderDot renders the topologies as Graphviz DOT, a cluster per subgraph
+func renderDot(topologies []*Topology) string {
+	var b strings.Builder
+	b.WriteString("digraph replication {\n")
+	for i, topology := range topologies {
+		fmt.Fprintf(&b, "  subgraph cluster_%d {\n    label=%s;\n", i, dotString(topology.Cluster))
+		for _, node := range topology.Nodes {
+			style := ""
+			switch node.Role {
+			case primaryRole:
+				style = ", shape=doubleoctagon"
+			case failedRole:
+				style = ", style=dashed, color=red"
+			case foreignRole:
+				style = ", style=dotted, color=orange"
+			}
+			fmt.Fprintf(&b, "    %s [label=%s%s];\n", dotString(topology.Cluster+"/"+node.Host), dotString(node.labelLines()...), style)
+		}
+		for _, edge := range topology.Edges {
+			fmt.Fprintf(&b, "    %s -> %s [label=%s];\n", dotString(topology.Cluster+"/"+edge.Upstream), dotString(topology.Cluster+"/"+edge.Standby), dotString(edge.label()))
+		}
+		b.WriteString("  }\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// renderMermaid renders the topologies as a Mermaid flowchart, a cluster per subgraph
+func renderMermaid(topologies []*Topology) string {
+	var b strings.Builder
+	b.WriteString("flowchart TD\n")
+	for i, topology := range topologies {
+		fmt.Fprintf(&b, "  subgraph c%d[%s]\n", i, mermaidString(topology.Cluster))
+		ids := make(map[string]string)
+		for j, node := range topology.Nodes {
+			ids[node.Host] = fmt.Sprintf("c%dn%d", i, j)
+			label := mermaidString(node.labelLines()...)
+			switch node.Role {
+			case primaryRole:
+				fmt.Fprintf(&b, "    %s{{%s}}\n", ids[node.Host], label)
+			case failedRole:
+				fmt.Fprintf(&b, "    %s[/%s/]\n", ids[node.Host], label)
+			default:
+				fmt.Fprintf(&b, "    %s[%s]\n", ids[node.Host], label)
+			}
+		}
+		for _, edge := range topology.Edges {
+			fmt.Fprintf(&b, "    %s -->|%s| %s\n", ids[edge.Upstream], mermaidString(edge.label()), ids[edge.Standby])
+		}
+		b.WriteString("  end\n")
+	}
+	return b.String()
+}
+
+// topologies returns the topologies of the clusters collected at least once, all or the one given by the cluster parameter
+func (e *Exporter) topologies(clusterName string) []*Topology {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	topologies := []*Topology{}
+	for name, r := range e.runners {
+		if clusterName != "" && name != clusterName {
+			continue
+		}
+		if state := r.cluster.getLastState(); state != nil {
+			topologies = append(topologies, buildTopology(name, state))
+		}
+	}
+	sort.Slice(topologies, func(i, j int) bool { return topologies[i].Cluster < topologies[j].Cluster })
+	return topologies
+}
+
+// ServeTopology handles GET /topology.json, /topology.dot and /topology.mmd
+func (e *Exporter) ServeTopology(w http.ResponseWriter, r *http.Request) {
+	topologies := e.topologies(r.URL.Query().Get("cluster"))
+	switch r.URL.Path {
+	case "/topology.json":
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(topologies); err != nil {
+			log.error("encoding topology error: %v", err)
+		}
+	case "/topology.dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		_, _ = w.Write([]byte(renderDot(topologies)))
+	case "/topology.mmd":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(renderMermaid(topologies)))
+	default:
+		http.NotFound(w, r)
+	}
+}
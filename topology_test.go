@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTopology_build(t *testing.T) {
+	master := &NodeState{host: "node-1", currentWalLsnBytes: 1000,
+		walSenders:       []*WalSenderState{{applicationName: "node-2", syncState: "sync", replayLagSeconds: 0.5, hasLag: true}},
+		replicationSlots: []*ReplicationSlotState{{slotName: "node_2", slotType: "physical", active: true}},
+	}
+	direct := &NodeState{host: "node-2", isInRecovery: true, walReceiver: &WalReceiverState{senderHost: "node-1"}, lastWalReceiveLsnBytes: 900, lastWalReplayLsnBytes: 800}
+	cascaded := &NodeState{host: "node-3", isInRecovery: true, walReceiver: &WalReceiverState{senderHost: "node-2"}, lastWalReceiveLsnBytes: 850, lastWalReplayLsnBytes: 850}
+	failed := &NodeState{host: "node-4", err: errors.New("connection refused")}
+	state := &ClusterState{
+		masters: []*NodeState{master},
+		slaves:  map[string]*NodeState{"node-2": direct, "node-3": cascaded},
+		failed:  map[string]*NodeState{"node-4": failed},
+	}
+	state.resolveUpstreams(net.LookupHost)
+
+	topology := buildTopology("test", state)
+	assert.Len(t, topology.Nodes, 4)
+	assert.Equal(t, primaryRole, topology.Nodes[0].Role)
+	assert.Len(t, topology.Nodes[0].Slots, 1)
+	assert.Equal(t, failedRole, topology.Nodes[3].Role)
+	assert.Len(t, topology.Edges, 2)
+	assert.Equal(t, "sync", topology.Edges[0].SyncState)
+	assert.Equal(t, 0.5, *topology.Edges[0].ReplayLagSeconds)
+	assert.Equal(t, "node-2", topology.Edges[1].Upstream)
+	assert.Equal(t, uint64(50), topology.Edges[1].ReceiveLagBytes)
+	assert.Nil(t, topology.Edges[1].ReplayLagSeconds)
+
+	dot := renderDot([]*Topology{topology})
+	assert.Contains(t, dot, `"test/node-2" -> "test/node-3" [label="receive lag 50 B, replay lag 50 B"];`)
+	mermaid := renderMermaid([]*Topology{topology})
+	assert.Contains(t, mermaid, `c0n1 -->|"receive lag 50 B, replay lag 50 B"| c0n2`)
+}
+
+func TestTopology_buildByClientAddr(t *testing.T) {
+	master := &NodeState{host: "node-1", walSenders: []*WalSenderState{
+		{applicationName: "walreceiver", clientAddr: "10.0.0.2", syncState: "sync"},
+		{applicationName: "walreceiver", clientAddr: "2001:db8::3", syncState: "async", replayLagSeconds: 1.5, hasLag: true},
+	}}
+	state := &ClusterState{
+		masters: []*NodeState{master},
+		slaves: map[string]*NodeState{
+			"10.0.0.2":                  {host: "10.0.0.2", isInRecovery: true},
+			"2001:0db8:0000:0000::0003": {host: "2001:0db8:0000:0000::0003", isInRecovery: true},
+		},
+	}
+
+	topology := buildTopology("test", state)
+	assert.Len(t, topology.Edges, 2)
+	assert.Equal(t, "10.0.0.2", topology.Edges[0].Standby)
+	assert.Equal(t, "sync", topology.Edges[0].SyncState)
+	assert.Equal(t, "2001:0db8:0000:0000::0003", topology.Edges[1].Standby)
+	assert.Equal(t, "async", topology.Edges[1].SyncState)
+	assert.Equal(t, 1.5, *topology.Edges[1].ReplayLagSeconds)
+}
+
+func TestTopology_renderEscapes(t *testing.T) {
+	topology := &Topology{Cluster: `or"ders`, Nodes: []*TopologyNode{
+		{Host: `node"1`, Role: primaryRole, Slots: []*TopologySlot{{Name: `slot\1`, Type: "physical", Active: true}}},
+		{Host: "node<2>#", Role: standbyRole},
+	}, Edges: []*TopologyEdge{{Upstream: `node"1`, Standby: "node<2>#"}}}
+
+	dot := renderDot([]*Topology{topology})
+	assert.Contains(t, dot, `label="or\"ders";`)
+	assert.Contains(t, dot, `"or\"ders/node\"1" [label="node\"1 (primary)\nslot slot\\1 active=true retained 0 B", shape=doubleoctagon];`)
+	assert.Contains(t, dot, `"or\"ders/node\"1" -> "or\"ders/node<2>#"`)
+
+	mermaid := renderMermaid([]*Topology{topology})
+	assert.Contains(t, mermaid, `subgraph c0["or#quot;ders"]`)
+	assert.Contains(t, mermaid, `c0n0{{"node#quot;1 (primary)<br/>slot slot\1 active=true retained 0 B"}}`)
+	assert.Contains(t, mermaid, `c0n1["node#lt;2#gt;#35; (standby)"]`)
+}
+
+func TestExporter_ServeTopology(t *testing.T) {
+	exporter := NewExporter(&Options{}, nil, nil)
+	for _, name := range []string{"orders", "billing", "new"} {
+		cluster := NewCluster(nil, name, []string{"node-1", "node-2"}, 0, 0)
+		if name != "new" {
+			// the new cluster hasn't been collected yet
+			cluster.setLastState(&ClusterState{masters: []*NodeState{{host: "node-1"}}, slaves: map[string]*NodeState{"node-2": {host: "node-2", isInRecovery: true}}})
+		}
+		exporter.runners[name] = &ClusterRunner{cluster: cluster}
+	}
+	serve := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		exporter.ServeTopology(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	w := serve("/topology.json")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var topologies []*Topology
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &topologies))
+	assert.Len(t, topologies, 2)
+	assert.Equal(t, "billing", topologies[0].Cluster)
+	assert.Equal(t, "orders", topologies[1].Cluster)
+	assert.Len(t, topologies[1].Edges, 1)
+
+	w = serve("/topology.json?cluster=orders")
+	topologies = nil
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &topologies))
+	assert.Len(t, topologies, 1)
+	assert.Equal(t, "orders", topologies[0].Cluster)
+
+	w = serve("/topology.json?cluster=unknown")
+	assert.Equal(t, "[]\n", w.Body.String())
+
+	w = serve("/topology.dot?cluster=billing")
+	assert.Equal(t, "text/vnd.graphviz; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `"billing/node-1" -> "billing/node-2"`)
+	assert.NotContains(t, w.Body.String(), "orders")
+
+	w = serve("/topology.mmd")
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `subgraph c0["billing"]`)
+	assert.Contains(t, w.Body.String(), `subgraph c1["orders"]`)
+
+	w = serve("/topology.svg")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}